@@ -2,19 +2,81 @@
 package weakcache
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"hash/maphash"
+	"io"
+	"log/slog"
+	"math"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Sizer is implemented by values which report their size
+// for the WithMaxBytes limit.
+type Sizer interface {
+	Size() int64
+}
+
 // Record is a reference-counted cache record.
+//
+// The cache holds the value of a record until the record is evicted,
+// after which the value is released. A value must not reference a record
+// pointer returned for it, since the pointer would stay reachable through
+// the cache and the record would never be unreferenced.
 type Record struct {
 	Value     interface{}
+	key       string
+	gen       uint64
+	created   int64
+	size      int64
+	weight    int64
+	version   string
 	minTTL    int64
+	maxTTL    int64
 	expires   int64
 	refs      uint
 	lastUnref int64
+	refSince  int64
+	leaked    bool
+	scopes    []func() bool
+	// freq is the decayed access frequency at freqTime.
+	freq     float64
+	freqTime int64
+}
+
+// Age returns how long the record has been cached at time now.
+func (r *Record) Age(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, r.created))
+}
+
+// ID returns the identity of the cached record. It is assigned when the
+// record is created and is the same in all pointers to the record, including
+// after the record was unreferenced and fetched again. A record created
+// again after the previous one was evicted has a new ID. The ID is zero
+// if the value was not cached.
+func (r *Record) ID() uint64 {
+	return r.gen
+}
+
+// Stale reports whether the record is past its maxTTL at time now.
+// A stale record is returned by a failed fetch with WithServeStaleOnError.
+func (r *Record) Stale(now time.Time) bool {
+	return r.expires > 0 && r.expires < now.UnixNano()
+}
+
+// frequency returns the access frequency of the record
+// decayed from freqTime to now.
+func (r *Record) frequency(now int64) float64 {
+	if r.freq == 0 || now <= r.freqTime {
+		return r.freq
+	}
+	return r.freq * math.Exp2(-float64(now-r.freqTime)/float64(freqHalfLife))
 }
 
 // isExpired reports if the record has expired or
@@ -30,32 +92,230 @@ func (r Record) isExpired(now int64) bool {
 	return false
 }
 
-type recordMap map[uint64]Record
+type recordMap map[uint64]*Record
+
+// sweepItem is a position in the sweep queue. lastUnref identifies
+// the unreachable record the item was queued for, so that items
+// left behind by revived or deleted records can be skipped.
+type sweepItem struct {
+	index     uint64
+	lastUnref int64
+}
+
+// defaultSweepLimit is the maximum number of unreachable records
+// inspected by a single GC tick.
+const defaultSweepLimit = 10000
+
+// sweepQueueSlack is the number of stale items the sweep queue may hold
+// beyond twice the number of unreachable records before it is compacted.
+const sweepQueueSlack = 64
+
+// maxGCBackoff is the maximum factor by which an idle
+// GC loop extends its interval.
+const maxGCBackoff = 16
+
+// adaptiveSweepDivisor is the part of the sweep backlog
+// inspected by a single adaptive sweep.
+const adaptiveSweepDivisor = 16
+
+// freqHalfLife is the time in which the access frequency
+// of a record decays by half with the LFU eviction policy.
+const freqHalfLife = time.Minute
+
+// EvictionPolicy selects the unreferenced records evicted
+// first when the cache exceeds its size limit.
+type EvictionPolicy int
+
+const (
+	// LRU evicts the least recently unreferenced records first.
+	LRU EvictionPolicy = iota
+	// LFU evicts the least frequently used records first.
+	LFU
+)
 
 type fetch func() (interface{}, error)
 
+type fetchTTL func() (interface{}, time.Duration, error)
+
+type fetchVersion func() (interface{}, string, error)
+
+type fetchContext func(ctx context.Context) (interface{}, error)
+
+type fetchExtras func() (interface{}, map[string]interface{}, error)
+
+// versioned is a value returned by a fetchVersion fallback.
+type versioned struct {
+	value   interface{}
+	version string
+}
+
+// withExtras is a value returned by a fetchExtras fallback.
+type withExtras struct {
+	value  interface{}
+	extras map[string]interface{}
+}
+
+// ErrClosed is returned by Fetch when the cache is closed.
+var ErrClosed = errors.New("weakcache: cache is closed")
+
+// ErrTooManyFetches is returned by Fetch when the maximum number
+// of concurrent fetches has been reached in fail-fast mode.
+var ErrTooManyFetches = errors.New("weakcache: too many concurrent fetches")
+
+// ErrFetchTimeout is returned by Fetch when the fallback
+// does not complete within the fetch timeout.
+var ErrFetchTimeout = errors.New("weakcache: fetch timed out")
+
+// ErrFetchPanicked is returned by Fetch when the fallback panics.
+// The returned error wraps it together with the recovered value.
+var ErrFetchPanicked = errors.New("weakcache: fetch panicked")
+
+// ErrDoNotCache can be returned by a fallback with a value which is
+// returned to the callers without being cached, so that the next fetch
+// calls the fallback again. It may be wrapped.
+var ErrDoNotCache = errors.New("weakcache: do not cache")
+
+// ErrNotCached is returned by FetchOrError on a cache miss.
+var ErrNotCached = errors.New("weakcache: key is not cached")
+
+// ErrFetchCycle is returned by FetchContext when a fallback fetches,
+// directly or through other fallbacks, the key it is fetching.
+var ErrFetchCycle = errors.New("weakcache: fetch cycle")
+
+// fetchChain is a fallback context value which links the keys
+// whose fallbacks are running to fetch the current key.
+type fetchChain struct {
+	cache  *Cache
+	index  uint64
+	parent *fetchChain
+}
+
+type fetchChainKey struct{}
+
+// call is an in-flight fallback. Callers fetching the same index
+// while the fallback is running wait for its result instead of
+// running their own fallback.
+type call struct {
+	key      string
+	done     chan struct{}
+	waiters  uint
+	finished bool
+	rec      Record
+	err      error
+}
+
 // Cache is a reference-counting cache which lets keys and values
 // that have no reference outside of the cache be garbage collected.
 type Cache struct {
-	mu          sync.Mutex
-	gcInterval  time.Duration
-	reachable   recordMap
-	unreachable recordMap
-	seed        maphash.Seed
-	quit        chan struct{}
+	mu            sync.Mutex
+	gcInterval    time.Duration
+	reachable     recordMap
+	unreachable   recordMap
+	calls         map[uint64]*call
+	fetchSem      chan struct{}
+	fetchTimeout  time.Duration
+	fetchAttempts int
+	fetchBackoff  func(attempt int) time.Duration
+	maxBytes      int64
+	bytes         int64
+	// unreachableBytes is the total size of the unreachable records.
+	unreachableBytes int64
+	failFast         bool
+	sweepQueue       []sweepItem
+	sweepLimit       int
+	adaptiveSweep    bool
+	policy           EvictionPolicy
+	// sweepQueued is the number of records which became
+	// unreachable since the previous sweep.
+	sweepQueued int
+	// lastSweep is the time of the last sweep
+	// which inspected the whole sweep queue.
+	lastSweep      int64
+	capacity       int
+	maxStale       time.Duration
+	fetchDeadline  float64
+	nextGen        uint64
+	seed           maphash.Seed
+	hash           func(key string) uint64
+	onEvict        func(key string, value interface{})
+	onReplace      func(key string, oldValue, newValue interface{})
+	evictFilter    func(key string, value interface{}) bool
+	validate       func(value interface{}) bool
+	onError        func(err error)
+	logger         *slog.Logger
+	autoClose      bool
+	softMaxTTL     bool
+	cacheNil       bool
+	syncEviction   bool
+	slidingGrace   bool
+	leakThreshold  time.Duration
+	slidingMaxTTL  bool
+	fetchLatency   bool
+	defaultMinTTL  time.Duration
+	defaultMaxTTL  time.Duration
+	refcountChecks bool
+	evicted        []eviction
+	// counts holds the number of reachable records in the high
+	// 32 bits and the number of unreachable records in the low bits.
+	counts atomic.Uint64
+	stats  stats
+	closed bool
+	quit   chan struct{}
+	// ctx is canceled when the cache is closed.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// gcIdle is set when the GC loop backs off, so that the next
+	// unreachable record wakes it up through gcWake.
+	gcIdle bool
+	gcWake chan struct{}
+
+	loopMu      sync.Mutex
+	loopWG      sync.WaitGroup
+	loopRunning bool
+	loopPaused  bool
+	loopClosed  bool
+	loopStop    chan struct{}
+	intervalCh  chan time.Duration
+
+	eventsMu     sync.Mutex
+	events       chan EvictionEvent
+	eventsClosed bool
+
+	unrefMu    sync.Mutex
+	unrefQueue []unrefItem
+	unrefBusy  bool
+	unrefIdle  []chan struct{}
+
+	evictMu    sync.Mutex
+	evictQueue []eviction
+	evictBusy  bool
+	evictIdle  []chan struct{}
 }
 
-// New creates an empty cache with specified GC interval.
-func New(gcInterval time.Duration) *Cache {
+// New creates an empty cache with the specified options.
+func New(opts ...Option) *Cache {
 	c := &Cache{
-		gcInterval:  gcInterval,
-		reachable:   make(recordMap),
-		unreachable: make(recordMap),
-		seed:        maphash.MakeSeed(),
-		quit:        make(chan struct{}),
+		gcInterval:   defaultGCInterval,
+		calls:        make(map[uint64]*call),
+		sweepLimit:   defaultSweepLimit,
+		cacheNil:     true,
+		fetchLatency: true,
+		seed:         maphash.MakeSeed(),
+		quit:         make(chan struct{}),
+		intervalCh:   make(chan time.Duration),
+		gcWake:       make(chan struct{}, 1),
+	}
+
+	for _, opt := range opts {
+		opt(c)
 	}
 
-	go c.gcLoop()
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	c.reachable = make(recordMap, c.capacity)
+	c.unreachable = make(recordMap, c.capacity)
+
+	c.SetGCInterval(c.gcInterval)
 
 	return c
 }
@@ -63,136 +323,1676 @@ func New(gcInterval time.Duration) *Cache {
 // Fetch gets or sets a record. It calls fetch as a fallback on cache miss.
 // minTTL specifies how long the record will survive without being referenced.
 // maxTTL specifies the maximum lifetime of the record.
+// A zero maxTTL means no limit. Otherwise, maxTTL is a hard limit which
+// takes precedence over minTTL, so a minTTL larger than maxTTL is
+// reduced to maxTTL.
+//
+// The cache is not locked while fetch runs. Concurrent callers
+// of the same key wait for a single fetch to complete.
+//
+// fetch may fetch other keys from the cache, but a fallback which fetches
+// its own key, directly or through other fallbacks, waits for itself forever.
+// Such fetches must all use FetchContext, passing on the ctx of the fallback,
+// so that the cycle is detected and ErrFetchCycle is returned.
 func (c *Cache) Fetch(key string, minTTL, maxTTL time.Duration, fetch fetch) (*Record, error) {
+	return c.FetchTTL(key, minTTL, maxTTL, func() (interface{}, time.Duration, error) {
+		value, err := fetch()
+		return value, 0, err
+	})
+}
+
+// FetchDefault is like Fetch with the TTLs set by WithDefaultTTL.
+func (c *Cache) FetchDefault(key string, fetch fetch) (*Record, error) {
+	return c.Fetch(key, c.defaultMinTTL, c.defaultMaxTTL, fetch)
+}
+
+// FetchSoft is like Fetch with a zero minTTL. The record is evicted as soon
+// as all pointers to it have been garbage collected, like in a weak map.
+// Soft records coexist with records which have a minTTL.
+func (c *Cache) FetchSoft(key string, maxTTL time.Duration, fetch fetch) (*Record, error) {
+	return c.Fetch(key, 0, maxTTL, fetch)
+}
+
+// FetchConditional is like Fetch but the fallback also returns a version of
+// the value. When an expired record of key is fetched again and the fallback
+// returns the same non-empty version, the existing record is kept and its
+// lifetime is extended instead of replacing it with the new value.
+// The eviction callback does not run for the kept record.
+func (c *Cache) FetchConditional(key string, minTTL, maxTTL time.Duration, fetch fetchVersion) (*Record, error) {
+	return c.acquire(context.Background(), key, c.index(key), 0, minTTL, maxTTL, func() (interface{}, time.Duration, error) {
+		value, version, err := fetch()
+		if err != nil || version == "" {
+			return value, 0, err
+		}
+		return versioned{value: value, version: version}, 0, nil
+	})
+}
+
+// FetchExtras is like Fetch but the fallback also returns extra entries
+// by key, such as related keys returned by a batch backend. If the value
+// of key is cacheable, the extras are stored as unreferenced records with
+// the same TTLs, even if no caller waits for key anymore. Keys which already
+// have an unexpired record keep it, like with Preload.
+func (c *Cache) FetchExtras(key string, minTTL, maxTTL time.Duration, fetch fetchExtras) (*Record, error) {
+	return c.acquire(context.Background(), key, c.index(key), 0, minTTL, maxTTL, func() (interface{}, time.Duration, error) {
+		value, extras, err := fetch()
+		if err != nil || len(extras) == 0 {
+			return value, 0, err
+		}
+		return withExtras{value: value, extras: extras}, 0, nil
+	})
+}
+
+// FetchContext is like Fetch but stops waiting for the fallback when ctx is
+// done, returning context.Cause(ctx). The fallback is called with a context
+// which has the values of ctx but is not canceled with it, since its result
+// may be shared with other callers. If no caller is waiting when the fallback
+// completes, its result is discarded.
+//
+// The fallback context is canceled with ErrClosed as the cause when the cache
+// is closed. With WithFetchDeadline, it also has a deadline derived from
+// maxTTL, or the deadline of ctx if it is earlier.
+//
+// A fallback may fetch other keys by passing its context to FetchContext.
+// If the fallbacks form a cycle, the fetch which would complete the cycle
+// returns ErrFetchCycle instead of waiting for itself.
+func (c *Cache) FetchContext(ctx context.Context, key string, minTTL, maxTTL time.Duration, fetch fetchContext) (*Record, error) {
+	index := c.index(key)
+
+	parent, _ := ctx.Value(fetchChainKey{}).(*fetchChain)
+	for link := parent; link != nil; link = link.parent {
+		if link.cache == c && link.index == index {
+			return nil, fmt.Errorf("%w: %q", ErrFetchCycle, key)
+		}
+	}
+
+	return c.acquire(ctx, key, index, 0, minTTL, maxTTL, func() (interface{}, time.Duration, error) {
+		chain := &fetchChain{cache: c, index: index, parent: parent}
+		fetchCtx, cancel := context.WithCancelCause(context.WithValue(context.WithoutCancel(ctx), fetchChainKey{}, chain))
+		defer cancel(nil)
+
+		stop := context.AfterFunc(c.ctx, func() {
+			cancel(ErrClosed)
+		})
+		defer stop()
+
+		if c.fetchDeadline > 0 && maxTTL > 0 {
+			deadline := time.Now().Add(time.Duration(c.fetchDeadline * float64(maxTTL)))
+			if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+				deadline = d
+			}
+			var cancel context.CancelFunc
+			fetchCtx, cancel = context.WithDeadline(fetchCtx, deadline)
+			defer cancel()
+		}
+
+		value, err := fetch(fetchCtx)
+		return value, 0, err
+	})
+}
+
+// FetchScoped is like FetchDefault but the record is also invalidated when
+// ctx is done, regardless of its TTLs. It stops waiting for the fallback
+// when ctx is done, returning context.Cause(ctx).
+func (c *Cache) FetchScoped(ctx context.Context, key string, fetch fetch) (*Record, error) {
 	index := c.index(key)
 
+	rec, err := c.acquire(ctx, key, index, 0, c.defaultMinTTL, c.defaultMaxTTL, func() (interface{}, time.Duration, error) {
+		value, err := fetch()
+		return value, 0, err
+	})
+	if err != nil || rec.gen == 0 {
+		return rec, err
+	}
+
+	c.mu.Lock()
+	defer c.unlock()
+
+	// The referenced record is reachable unless it was invalidated since.
+	if cached, ok := c.reachable[index]; ok && cached.gen == rec.gen {
+		gen := rec.gen
+		stop := context.AfterFunc(ctx, func() {
+			c.mu.Lock()
+			defer c.unlock()
+
+			for _, m := range []recordMap{c.reachable, c.unreachable} {
+				if rec, ok := m[index]; ok && rec.gen == gen && !c.closed {
+					c.evict(m, index, rec, EvictionInvalidated)
+				}
+			}
+		})
+		cached.scopes = append(cached.scopes, stop)
+	}
+
+	return rec, nil
+}
+
+// FetchTTL is like Fetch but the fallback also returns a TTL for the new record.
+// A positive ttl overrides maxTTL and a zero ttl uses maxTTL. If ttl is negative,
+// the value is returned to the callers without being cached.
+func (c *Cache) FetchTTL(key string, minTTL, maxTTL time.Duration, fetch fetchTTL) (*Record, error) {
+	return c.acquire(context.Background(), key, c.index(key), 0, minTTL, maxTTL, fetch)
+}
+
+// FetchWeighted is like Fetch but stores weight on a new record.
+// When the cache is over capacity, unreferenced records with a lower
+// weight are evicted before records with a higher weight.
+func (c *Cache) FetchWeighted(key string, weight int64, minTTL, maxTTL time.Duration, fetch fetch) (*Record, error) {
+	return c.acquire(context.Background(), key, c.index(key), weight, minTTL, maxTTL, func() (interface{}, time.Duration, error) {
+		value, err := fetch()
+		return value, 0, err
+	})
+}
+
+// acquire fetches a record and sets a finalizer on the returned pointer.
+func (c *Cache) acquire(ctx context.Context, key string, index uint64, weight int64, minTTL, maxTTL time.Duration, fetch fetchTTL) (*Record, error) {
 	// Acquire a unique pointer to the record. When the pointer gets garbage collected,
 	// the reference count for the record will be decremented.
-	rec, err := c.fetch(index, minTTL, maxTTL, fetch)
+	rec, err := c.fetchRef(ctx, key, index, weight, minTTL, maxTTL, fetch)
 	if err != nil {
 		return nil, err
 	}
 
-	runtime.SetFinalizer(rec, func(_ interface{}) {
-		go c.unref(index)
-	})
+	if rec.gen > 0 {
+		c.setFinalizer(index, rec)
+	}
 
 	return rec, nil
 }
 
-// Len returns the number of cached items.
-func (c *Cache) Len() int {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return len(c.reachable) + len(c.unreachable)
-}
+// fetchRef fetches a record referenced on behalf of the caller
+// within the fetch timeout.
+func (c *Cache) fetchRef(ctx context.Context, key string, index uint64, weight int64, minTTL, maxTTL time.Duration, fetch fetchTTL) (*Record, error) {
+	if c.fetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, c.fetchTimeout, ErrFetchTimeout)
+		defer cancel()
+	}
 
-// Close stops the cache GC loop.
-func (c *Cache) Close() {
-	close(c.quit)
+	return c.fetch(ctx, key, index, weight, minTTL, maxTTL, fetch)
 }
 
-func (c *Cache) index(key string) uint64 {
-	var h maphash.Hash
-	h.SetSeed(c.seed)
-	h.WriteString(key)
-	return h.Sum64()
+// FetchValue is like Fetch but returns only the value. The reference
+// to the record is released before FetchValue returns, so the record is
+// unreferenced and is evicted after minTTL unless another pointer to it
+// is held. Use Fetch to keep the record alive while using the value.
+func (c *Cache) FetchValue(key string, minTTL, maxTTL time.Duration, fetch fetch) (interface{}, error) {
+	index := c.index(key)
+
+	rec, err := c.fetchRef(context.Background(), key, index, 0, minTTL, maxTTL, func() (interface{}, time.Duration, error) {
+		value, err := fetch()
+		return value, 0, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if rec.gen > 0 {
+		c.unref(index, rec.gen)
+	}
+
+	return rec.Value, nil
 }
 
-func (c *Cache) gcLoop() {
-	ticker := time.NewTicker(c.gcInterval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-c.quit:
-			return
-		case now := <-ticker.C:
-			nowNano := now.UnixNano()
-			c.mu.Lock()
-			// Clean up unreachable records,
-			for index, rec := range c.unreachable {
-				if rec.isExpired(nowNano) {
-					delete(c.unreachable, index)
-				}
+// Acquire is like Fetch but also returns a function which releases the
+// reference to the record immediately instead of when the pointer gets
+// garbage collected. Calling release more than once has no effect. If release
+// is never called, the reference is released by the garbage collector.
+func (c *Cache) Acquire(key string, minTTL, maxTTL time.Duration, fetch fetch) (rec *Record, release func(), err error) {
+	index := c.index(key)
+
+	rec, err = c.acquire(context.Background(), key, index, 0, minTTL, maxTTL, func() (interface{}, time.Duration, error) {
+		value, err := fetch()
+		return value, 0, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			if rec.gen > 0 {
+				runtime.SetFinalizer(rec, nil)
+				c.unref(index, rec.gen)
 			}
-			c.mu.Unlock()
-		}
+		})
+	}
+
+	return rec, release, nil
+}
+
+// Get returns a referenced record of key if it exists. Unlike Fetch,
+// it never runs a fallback. It returns false on a miss or if the
+// cache is closed.
+func (c *Cache) Get(key string) (*Record, bool) {
+	rec, ok := c.load(key, c.index(key))
+	if !ok {
+		c.stats.addMiss(key)
 	}
+	return rec, ok
 }
 
-func (c *Cache) fetch(index uint64, minTTL, maxTTL time.Duration, fetch fetch) (*Record, error) {
+// FetchOrError is like Get but returns ErrNotCached on a miss,
+// or ErrClosed if the cache is closed.
+func (c *Cache) FetchOrError(key string) (*Record, error) {
+	if rec, ok := c.Get(key); ok {
+		return rec, nil
+	}
+
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	closed := c.closed
+	c.mu.Unlock()
 
-	now := time.Now()
+	if closed {
+		return nil, ErrClosed
+	}
+	return nil, ErrNotCached
+}
 
-	get := func() *Record {
-		if rec, ok := c.unreachable[index]; ok {
-			// An unreachable record was found, make it reachable later.
-			delete(c.unreachable, index)
-			if rec.isExpired(now.UnixNano()) {
-				return nil
-			}
-			return &rec
-		} else if rec, ok = c.reachable[index]; ok {
-			if rec.isExpired(now.UnixNano()) {
-				delete(c.reachable, index)
-				return nil
-			}
-			// A reachable record was found.
-			return &rec
-		}
-		return nil
+// load returns a referenced record of key at index if it exists.
+// The key is not retained, so it may share memory with a mutable buffer.
+func (c *Cache) load(key string, index uint64) (*Record, bool) {
+	c.mu.Lock()
+
+	if c.closed {
+		c.unlock()
+		return nil, false
 	}
 
-	rec := get()
+	rec := c.get(key, index, time.Now().UnixNano())
 	if rec == nil {
-		// Create a new record.
-		value, err := fetch()
-		if err != nil {
-			return nil, err
+		c.unlock()
+		return nil, false
+	}
+
+	ref := c.hit(key, index, rec)
+	c.unlock()
+
+	c.setFinalizer(index, ref)
+	return ref, true
+}
+
+// LoadOrStore returns a referenced record of key if it exists. Otherwise,
+// it stores value and returns a referenced new record. The loaded result
+// is true if the value was loaded, false if stored. It returns nil
+// if the cache is closed.
+func (c *Cache) LoadOrStore(key string, value interface{}, minTTL, maxTTL time.Duration) (*Record, bool) {
+	index := c.index(key)
+
+	for {
+		c.mu.Lock()
+
+		if c.closed {
+			c.unlock()
+			return nil, false
 		}
-		rec = &Record{
-			Value:  value,
-			minTTL: int64(minTTL),
+
+		if rec := c.get(key, index, time.Now().UnixNano()); rec != nil {
+			ref := c.hit(key, index, rec)
+			c.unlock()
+
+			c.setFinalizer(index, ref)
+			return ref, true
 		}
-		if maxTTL > 0 {
-			rec.expires = now.Add(maxTTL).UnixNano()
+
+		if cl, ok := c.calls[index]; ok {
+			// Wait for the in-flight fallback and try again.
+			c.unlock()
+			<-cl.done
+			continue
 		}
+
+		c.stats.addMiss(key)
+		rec := c.insert(key, index, value, 0, "", minTTL, maxTTL, 1)
+		c.unlock()
+
+		c.setFinalizer(index, &rec)
+		return &rec, false
 	}
+}
 
-	rec.refs++
+// FetchResult is the result of FetchAsync.
+type FetchResult struct {
+	Record *Record
+	Err    error
+}
 
-	// Store a value in the map. The pointer is returned only to the caller
-	// so that the caller triggers a finalizer when the pointer is garbage collected.
-	c.reachable[index] = *rec
+// FetchAsync runs Fetch in a new goroutine. The returned channel
+// receives the result and is closed.
+func (c *Cache) FetchAsync(key string, minTTL, maxTTL time.Duration, fetch fetch) <-chan FetchResult {
+	ch := make(chan FetchResult, 1)
 
-	return rec, nil
+	go func() {
+		defer close(ch)
+		rec, err := c.Fetch(key, minTTL, maxTTL, fetch)
+		ch <- FetchResult{Record: rec, Err: err}
+	}()
+
+	return ch
 }
 
-// unref is called when a pointer to a cache record gets garbage collected.
-func (c *Cache) unref(index uint64) {
+// Store stores value as the record of key and returns a referenced record.
+// An existing record of key is evicted. Pointers to the evicted record
+// keep their value but are no longer returned by Fetch. It returns nil
+// if the cache is closed.
+func (c *Cache) Store(key string, value interface{}, minTTL, maxTTL time.Duration) *Record {
+	index := c.index(key)
+
+	c.mu.Lock()
+
+	if c.closed {
+		c.unlock()
+		return nil
+	}
+	rec := c.insert(key, index, value, 0, "", minTTL, maxTTL, 1)
+	c.unlock()
+
+	c.setFinalizer(index, &rec)
+
+	return &rec
+}
+
+// Contains reports whether an unexpired record exists for key.
+// Unlike Fetch, it does not reference the record.
+func (c *Cache) Contains(key string) bool {
+	index := c.index(key)
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	rec, ok := c.reachable[index]
+	_, ok := c.peek(key, index, time.Now().UnixNano())
+	return ok
+}
+
+// PeekMulti returns the values of the unexpired records of keys under a
+// single lock acquisition. Missing keys are omitted. Like Contains,
+// it does not reference the records.
+func (c *Cache) PeekMulti(keys []string) map[string]interface{} {
+	values := make(map[string]interface{}, len(keys))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	for _, key := range keys {
+		if rec, ok := c.peek(key, c.index(key), now); ok {
+			values[key] = rec.Value
+		}
+	}
+
+	return values
+}
+
+// UpdateValue replaces the value of the unexpired record of key, keeping
+// its references and TTLs. It reports whether the record was updated, which
+// is false if the record does not exist or the cache is closed. Records
+// returned before the update are copies and keep the old value.
+func (c *Cache) UpdateValue(key string, value interface{}) bool {
+	index := c.index(key)
+
+	c.mu.Lock()
+	defer c.unlock()
+
+	if c.closed {
+		return false
+	}
+
+	rec, ok := c.peek(key, index, time.Now().UnixNano())
 	if !ok {
-		// The record probably expired during fetch
-		// while having other live pointers.
-		return
+		return false
 	}
 
-	// Decrease reference count for the record.
-	rec.refs--
-	if rec.refs > 0 {
-		// Record has other live pointers.
-		c.reachable[index] = rec
-	} else {
+	rec.Value = value
+	size := rec.size
+	rec.size = 0
+	if sizer, ok := value.(Sizer); ok {
+		rec.size = sizer.Size()
+	}
+	c.bytes += rec.size - size
+	if c.unreachable[index] == rec {
+		c.unreachableBytes += rec.size - size
+	}
+	c.shrink()
+
+	return true
+}
+
+// RecordState is whether a record is referenced.
+type RecordState int
+
+const (
+	// Reachable means the record has live pointers.
+	Reachable RecordState = iota
+	// Unreachable means the record has no live pointers
+	// and is evicted when it expires.
+	Unreachable
+)
+
+func (s RecordState) String() string {
+	switch s {
+	case Reachable:
+		return "reachable"
+	case Unreachable:
+		return "unreachable"
+	default:
+		return "unknown"
+	}
+}
+
+// State reports the state of the record of key and whether it exists,
+// including expired records which have not been evicted yet.
+// It does not reference the record.
+func (c *Cache) State(key string) (RecordState, bool) {
+	index := c.index(key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if rec, ok := c.reachable[index]; ok && rec.key == key {
+		return Reachable, true
+	}
+	if rec, ok := c.unreachable[index]; ok && rec.key == key {
+		return Unreachable, true
+	}
+	return 0, false
+}
+
+// Len returns the number of cached items.
+// It does not lock the cache.
+func (c *Cache) Len() int {
+	reachable, unreachable := c.Counts()
+	return reachable + unreachable
+}
+
+// Counts returns the number of referenced and unreferenced cached items.
+// It does not lock the cache.
+func (c *Cache) Counts() (reachable, unreachable int) {
+	counts := c.counts.Load()
+	return int(counts >> 32), int(counts & math.MaxUint32)
+}
+
+// storeCounts stores the sizes of the record maps for Counts.
+// It is called before unlocking the cache after modifying the maps.
+func (c *Cache) storeCounts() {
+	c.counts.Store(uint64(len(c.reachable))<<32 | uint64(len(c.unreachable)))
+}
+
+// ForEach calls fn for each unexpired record in the cache.
+// If fn returns false, the iteration stops.
+//
+// fn is called while the cache mutex is held so it must not
+// call any methods on the cache, otherwise it will deadlock.
+// Records are not referenced during the iteration.
+func (c *Cache) ForEach(fn func(key string, value interface{}) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now().UnixNano()
+
+	for _, m := range []recordMap{c.reachable, c.unreachable} {
+		for _, rec := range m {
+			if rec.isExpired(now) {
+				continue
+			}
+			if !fn(rec.key, rec.Value) {
+				return
+			}
+		}
+	}
+}
+
+// Range calls fn for each reachable record with a referenced pointer to
+// the record, so that the record is not evicted while fn holds it.
+// If fn returns false, the iteration stops. Unlike ForEach, fn is called
+// without holding the cache mutex. Records which become reachable
+// during the iteration may not be visited.
+func (c *Cache) Range(fn func(key string, rec *Record) bool) {
+	c.mu.Lock()
+	indexes := make([]uint64, 0, len(c.reachable))
+	for index := range c.reachable {
+		indexes = append(indexes, index)
+	}
+	c.mu.Unlock()
+
+	for _, index := range indexes {
+		c.mu.Lock()
+		rec, ok := c.reachable[index]
+		if !ok || c.closed || (!c.softMaxTTL && rec.isExpired(time.Now().UnixNano())) {
+			// The record was unreferenced or evicted since.
+			c.mu.Unlock()
+			continue
+		}
+		c.ref(rec)
+		ref := *rec
+		c.mu.Unlock()
+
+		c.setFinalizer(index, &ref)
+
+		if !fn(ref.key, &ref) {
+			return
+		}
+	}
+}
+
+// InvalidatePrefix evicts all records whose key starts with prefix
+// and returns the number of evicted records. It iterates over
+// all records in the cache.
+func (c *Cache) InvalidatePrefix(prefix string) int {
+	return c.InvalidateFunc(func(key string, _ interface{}) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// InvalidateFunc evicts all records for which pred returns true
+// and returns the number of evicted records.
+//
+// pred is called while the cache mutex is held so it must not
+// call any methods on the cache, otherwise it will deadlock.
+func (c *Cache) InvalidateFunc(pred func(key string, value interface{}) bool) int {
+	c.mu.Lock()
+	defer c.unlock()
+
+	if c.closed {
+		return 0
+	}
+
+	n := 0
+	for _, m := range []recordMap{c.reachable, c.unreachable} {
+		for index, rec := range m {
+			if pred(rec.key, rec.Value) {
+				c.evict(m, index, rec, EvictionInvalidated)
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+// InvalidateMulti evicts the records of keys under a single lock
+// acquisition and returns the number of evicted records.
+func (c *Cache) InvalidateMulti(keys []string) int {
+	c.mu.Lock()
+	defer c.unlock()
+
+	if c.closed {
+		return 0
+	}
+
+	n := 0
+	for _, key := range keys {
+		index := c.index(key)
+		for _, m := range []recordMap{c.reachable, c.unreachable} {
+			if rec, ok := m[index]; ok && rec.key == key {
+				// Pointers to the record keep its value. Their
+				// unrefs are ignored due to the generation.
+				c.evict(m, index, rec, EvictionInvalidated)
+				n++
+			}
+		}
+	}
+
+	return n
+}
+
+// Compact rebuilds the record maps and the sweep queue to fit the current
+// records, releasing the memory they grew to hold. Queued sweeps of deleted
+// records are dropped. Go maps do not shrink
+// when records are deleted, so it is useful after the number of records
+// has dropped. The records are kept as they are.
+func (c *Cache) Compact() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, m := range []*recordMap{&c.reachable, &c.unreachable} {
+		compacted := make(recordMap, len(*m))
+		for index, rec := range *m {
+			compacted[index] = rec
+		}
+		*m = compacted
+	}
+
+	c.sweepQueue = c.validSweepItems(make([]sweepItem, 0, len(c.unreachable)))
+}
+
+// SetGCInterval changes the interval of the GC loop.
+// A zero or negative interval pauses the GC loop.
+// If the cache is paused, the interval is used on Resume.
+func (c *Cache) SetGCInterval(d time.Duration) {
+	c.loopMu.Lock()
+	defer c.loopMu.Unlock()
+
+	if c.loopClosed {
+		return
+	}
+
+	c.gcInterval = d
+
+	if c.loopRunning {
+		c.intervalCh <- d
+	} else if d > 0 && !c.loopPaused {
+		c.startLoop(d)
+	}
+}
+
+// Pause stops the GC loop goroutine, keeping the contents of the cache.
+// Expired records are still evicted when they are fetched.
+// Pause is idempotent and does nothing after Close.
+func (c *Cache) Pause() {
+	c.loopMu.Lock()
+	defer c.loopMu.Unlock()
+
+	if c.loopClosed || c.loopPaused {
+		return
+	}
+
+	c.loopPaused = true
+
+	if c.loopRunning {
+		close(c.loopStop)
+		c.loopWG.Wait()
+		c.loopRunning = false
+	}
+}
+
+// Resume restarts the GC loop stopped by Pause with the current
+// GC interval. Resume is idempotent and does nothing after Close.
+func (c *Cache) Resume() {
+	c.loopMu.Lock()
+	defer c.loopMu.Unlock()
+
+	if c.loopClosed || !c.loopPaused {
+		return
+	}
+
+	c.loopPaused = false
+
+	if c.gcInterval > 0 {
+		c.startLoop(c.gcInterval)
+	}
+}
+
+// startLoop starts the GC loop. c.loopMu must be held.
+func (c *Cache) startLoop(d time.Duration) {
+	c.loopRunning = true
+	c.loopStop = make(chan struct{})
+	c.loopWG.Add(1)
+	go c.gcLoop(d, c.loopStop)
+}
+
+// Close stops the cache GC loop and closes the eviction event channel.
+// After Close, Fetch returns ErrClosed and the other methods
+// which modify the cache do nothing. Record pointers which are garbage
+// collected after Close are counted in Stats.OrphanedUnrefs.
+// With WithAutoClose, the values of the records left in the cache are closed.
+func (c *Cache) Close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	var remaining []*Record
+	if c.autoClose {
+		for _, m := range []recordMap{c.reachable, c.unreachable} {
+			for _, rec := range m {
+				remaining = append(remaining, rec)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	for _, rec := range remaining {
+		c.closeValue(rec.key, rec.Value)
+	}
+
+	c.cancel()
+
+	c.loopMu.Lock()
+	c.loopClosed = true
+	close(c.quit)
+	c.loopMu.Unlock()
+
+	c.closeEvents()
+}
+
+// CloseContext stops the cache GC loop and waits until the loop has exited,
+// until all pending unrefs have been applied and until the pending
+// eviction callbacks have run. It returns ctx.Err() if ctx is done before that.
+func (c *Cache) CloseContext(ctx context.Context) error {
+	c.Close()
+
+	loopDone := make(chan struct{})
+	go func() {
+		c.loopWG.Wait()
+		close(loopDone)
+	}()
+
+	select {
+	case <-loopDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if err := c.waitUnrefs(ctx); err != nil {
+		return err
+	}
+
+	return c.waitEvictions(ctx)
+}
+
+// Done returns a channel which is closed when the cache is closed.
+func (c *Cache) Done() <-chan struct{} {
+	return c.quit
+}
+
+// Index returns the index of key in the cache. Keys with
+// the same index collide and replace each other's records.
+func (c *Cache) Index(key string) uint64 {
+	return c.index(key)
+}
+
+func (c *Cache) index(key string) uint64 {
+	if c.hash != nil {
+		return c.hash(key)
+	}
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	h.WriteString(key)
+	return h.Sum64()
+}
+
+// gcLoop sweeps the cache every interval. While the sweeps evict nothing,
+// the interval is doubled up to maxGCBackoff times interval. It is reset when
+// a record becomes unreachable.
+func (c *Cache) gcLoop(interval time.Duration, stop <-chan struct{}) {
+	defer c.loopWG.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	tick := ticker.C
+	current := interval
+	for {
+		select {
+		case <-c.quit:
+			return
+		case <-stop:
+			return
+		case d := <-c.intervalCh:
+			if d > 0 {
+				interval, current = d, d
+				ticker.Reset(d)
+				tick = ticker.C
+			} else {
+				// Pause until the interval is set again.
+				ticker.Stop()
+				tick = nil
+			}
+		case <-c.gcWake:
+			if tick != nil && current != interval {
+				current = interval
+				ticker.Reset(current)
+			}
+		case now := <-tick:
+			c.mu.Lock()
+			if c.closed {
+				// Close closes the values left in the cache,
+				// they must not be evicted anymore.
+				c.mu.Unlock()
+				return
+			}
+			start := time.Now()
+			n := c.sweep(now.UnixNano())
+			if c.leakThreshold > 0 {
+				c.checkLeaks(now.UnixNano())
+			}
+			c.stats.addSweep(n, time.Since(start))
+			// Back off while the sweeps evict nothing.
+			idle := len(c.evicted) == 0 && (c.leakThreshold <= 0 || len(c.reachable) == 0)
+			c.gcIdle = idle
+			c.unlock()
+
+			if idle && current < maxGCBackoff*interval {
+				current *= 2
+				ticker.Reset(current)
+			} else if !idle && current != interval {
+				current = interval
+				ticker.Reset(current)
+			}
+		}
+	}
+}
+
+// unlock unlocks the cache and dispatches the eviction callbacks
+// for the records evicted while the lock was held.
+func (c *Cache) unlock() {
+	evicted := c.evicted
+	c.evicted = nil
+	c.storeCounts()
+	c.mu.Unlock()
+
+	if len(evicted) == 0 {
+		return
+	}
+
+	if c.syncEviction {
+		c.dispatchEvictions(evicted)
+	} else {
+		c.queueEvictions(evicted)
+	}
+}
+
+// dispatchEvictions runs the eviction callback, closes the values
+// and sends the events of evicted records in eviction order.
+func (c *Cache) dispatchEvictions(evicted []eviction) {
+	for _, ev := range evicted {
+		if c.onEvict != nil {
+			c.callEvict(ev.rec.key, ev.rec.Value)
+		}
+		if c.onReplace != nil {
+			c.callReplace(ev.rec.key, ev.rec.Value, ev.replacement)
+		}
+		if c.autoClose {
+			c.closeValue(ev.rec.key, ev.rec.Value)
+		}
+		c.sendEvent(ev)
+	}
+}
+
+// evict deletes the record at index from m. The eviction
+// callback runs and the event is sent when the cache is unlocked.
+func (c *Cache) evict(m recordMap, index uint64, rec *Record, reason EvictionReason) {
+	if c.unreachable[index] == rec {
+		c.unreachableBytes -= rec.size
+	}
+	delete(m, index)
+	for _, stop := range rec.scopes {
+		// Stop watching the contexts of the record.
+		stop()
+	}
+	rec.scopes = nil
+	c.bytes -= rec.size
+	c.stats.weight.Add(-rec.weight)
+	c.stats.evictions.Add(1)
+	c.evicted = append(c.evicted, eviction{
+		rec:    rec,
+		reason: reason,
+		time:   time.Now().UnixNano(),
+	})
+}
+
+// sweepTarget returns the maximum number of queued records to inspect
+// on a sweep. With adaptive sweeping, it is the number of records queued
+// since the previous sweep plus 1/adaptiveSweepDivisor of the older ones,
+// within c.sweepLimit.
+func (c *Cache) sweepTarget() int {
+	if !c.adaptiveSweep {
+		return c.sweepLimit
+	}
+
+	backlog := len(c.sweepQueue) - c.sweepQueued
+	target := c.sweepQueued + backlog/adaptiveSweepDivisor
+	if target < 1 {
+		target = 1
+	}
+	if c.sweepLimit > 0 && target > c.sweepLimit {
+		target = c.sweepLimit
+	}
+	c.sweepQueued = 0
+	c.stats.sweepTarget.Store(int64(target))
+
+	return target
+}
+
+// expire evicts the expired record rec at index from m unless the eviction
+// filter vetoes it. It reports whether the record was evicted.
+func (c *Cache) expire(m recordMap, index uint64, rec *Record, now int64) bool {
+	if c.vetoed(index, rec, now) {
+		return false
+	}
+	c.evict(m, index, rec, EvictionExpired)
+	return true
+}
+
+// vetoed reports whether the eviction filter vetoes the eviction of the
+// expired record rec at index. A vetoed record past its minTTL is granted
+// another grace period.
+func (c *Cache) vetoed(index uint64, rec *Record, now int64) bool {
+	if c.evictFilter == nil || c.evictFilter(rec.key, rec.Value) {
+		return false
+	}
+
+	if rec.lastUnref > 0 && rec.lastUnref+rec.minTTL < now {
+		rec.lastUnref = now
+	}
+	if c.unreachable[index] == rec {
+		// Consult the filter again on a later pass.
+		c.sweepQueue = append(c.sweepQueue, sweepItem{
+			index:     index,
+			lastUnref: rec.lastUnref,
+		})
+	}
+
+	return true
+}
+
+// shrink evicts unreachable records until the total size of the records
+// is within c.maxBytes. Records of the lowest weight are evicted first, and
+// of those the least recently unreferenced or, with LFU, the least
+// frequently used. Referenced records and records without a size
+// are never evicted, and nothing is evicted while the referenced
+// records alone exceed c.maxBytes.
+func (c *Cache) shrink() {
+	if c.maxBytes <= 0 || c.bytes <= c.maxBytes {
+		return
+	}
+	if c.bytes-c.unreachableBytes > c.maxBytes {
+		// The referenced records alone exceed the limit,
+		// so evicting would not bring the size within it.
+		return
+	}
+
+	type candidate struct {
+		index uint64
+		rec   *Record
+		freq  float64
+	}
+
+	now := time.Now().UnixNano()
+	candidates := make([]candidate, 0, len(c.unreachable))
+	for index, rec := range c.unreachable {
+		if rec.size == 0 {
+			// Evicting the record would not free any bytes.
+			continue
+		}
+		candidates = append(candidates, candidate{index, rec, rec.frequency(now)})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].rec.weight != candidates[j].rec.weight {
+			return candidates[i].rec.weight < candidates[j].rec.weight
+		}
+		if c.policy == LFU && candidates[i].freq != candidates[j].freq {
+			return candidates[i].freq < candidates[j].freq
+		}
+		return candidates[i].rec.lastUnref < candidates[j].rec.lastUnref
+	})
+
+	for _, cand := range candidates {
+		if c.bytes <= c.maxBytes {
+			return
+		}
+		c.evict(c.unreachable, cand.index, cand.rec, EvictionCapacity)
+	}
+}
+
+// callEvict runs the eviction callback, recovering from a panic.
+func (c *Cache) callEvict(key string, value interface{}) {
+	defer c.recoverCallback(key)
+	c.onEvict(key, value)
+}
+
+// callReplace runs the replace callback, recovering from a panic.
+func (c *Cache) callReplace(key string, oldValue, newValue interface{}) {
+	defer c.recoverCallback(key)
+	c.onReplace(key, oldValue, newValue)
+}
+
+// recoverCallback recovers from a panic in an eviction callback of key.
+func (c *Cache) recoverCallback(key string) {
+	if r := recover(); r != nil {
+		c.log(slog.LevelError, "weakcache: eviction callback panicked", "key", key, "panic", r)
+		if c.onError != nil {
+			c.onError(fmt.Errorf("weakcache: eviction callback panicked for %q: %v", key, r))
+		}
+	}
+}
+
+// log logs a message if a logger is set.
+func (c *Cache) log(level slog.Level, msg string, args ...interface{}) {
+	if c.logger != nil {
+		c.logger.Log(context.Background(), level, msg, args...)
+	}
+}
+
+// closeValue closes an evicted value if it implements io.Closer.
+func (c *Cache) closeValue(key string, value interface{}) {
+	closer, ok := value.(io.Closer)
+	if !ok {
+		return
+	}
+	if err := closer.Close(); err != nil {
+		c.log(slog.LevelError, "weakcache: closing evicted value", "key", key, "error", err)
+		if c.onError != nil {
+			c.onError(fmt.Errorf("weakcache: closing value of %q: %w", key, err))
+		}
+	}
+}
+
+// sweep cleans up expired unreachable records. It inspects at most
+// c.sweepTarget() queued records and resumes from where it left off
+// on the next call. A zero target inspects the entire queue.
+// It returns the number of inspected queue items.
+func (c *Cache) sweep(now int64) int {
+	n := len(c.sweepQueue)
+	if limit := c.sweepTarget(); limit > 0 && limit < n {
+		n = limit
+	}
+	if n == len(c.sweepQueue) {
+		c.lastSweep = now
+	}
+
+	for _, item := range c.sweepQueue[:n] {
+		rec, ok := c.unreachable[item.index]
+		if !ok || rec.lastUnref != item.lastUnref {
+			// The record was revived or deleted since it was queued.
+			continue
+		}
+		if rec.isExpired(now) && !c.isStale(rec, now) {
+			c.expire(c.unreachable, item.index, rec, now)
+			continue
+		}
+		// Inspect the record again on a later pass.
+		c.sweepQueue = append(c.sweepQueue, item)
+	}
+
+	c.sweepQueue = c.sweepQueue[n:]
+
+	return n
+}
+
+// checkLeaks counts and logs the records which have been referenced
+// for longer than c.leakThreshold. A record is counted once until it
+// is unreferenced. The referenced time is measured from the first
+// GC tick which saw the record referenced.
+func (c *Cache) checkLeaks(now int64) {
+	for _, rec := range c.reachable {
+		if rec.refSince == 0 {
+			rec.refSince = now
+			continue
+		}
+		if rec.leaked || now-rec.refSince < int64(c.leakThreshold) {
+			continue
+		}
+		rec.leaked = true
+		c.stats.leaks.Add(1)
+		c.log(slog.LevelWarn, "weakcache: suspected reference leak", "key", rec.key, "refs", rec.refs)
+	}
+}
+
+func (c *Cache) fetch(ctx context.Context, key string, index uint64, weight int64, minTTL, maxTTL time.Duration, fetch fetchTTL) (*Record, error) {
+	for {
+		c.mu.Lock()
+
+		if c.closed {
+			c.unlock()
+			c.log(slog.LevelDebug, "weakcache: fetch after close", "key", key)
+			return nil, ErrClosed
+		}
+
+		if rec := c.get(key, index, time.Now().UnixNano()); rec != nil {
+			ref := c.hit(key, index, rec)
+			c.unlock()
+			return ref, nil
+		}
+
+		cl, ok := c.calls[index]
+		if ok && cl.key != key {
+			// A colliding key is being fetched, try again when it completes.
+			c.unlock()
+			select {
+			case <-cl.done:
+				continue
+			case <-ctx.Done():
+				return nil, context.Cause(ctx)
+			}
+		}
+
+		c.stats.addMiss(key)
+
+		if !ok {
+			cl = &call{
+				key:  key,
+				done: make(chan struct{}),
+			}
+			c.calls[index] = cl
+		}
+
+		// The call references the new record on behalf of its waiters.
+		cl.waiters++
+		c.unlock()
+
+		if ok {
+			// Another fetch is running the fallback.
+			start := time.Now()
+			rec, err := c.wait(ctx, cl)
+			c.stats.addWait(time.Since(start))
+			return rec, err
+		}
+
+		if ctx.Done() != nil {
+			// Run the fallback in the background so that
+			// the waiters can give up on it.
+			go c.do(cl, index, weight, minTTL, maxTTL, fetch)
+		} else {
+			c.do(cl, index, weight, minTTL, maxTTL, fetch)
+		}
+
+		return c.wait(ctx, cl)
+	}
+}
+
+// wait waits for the result of cl. If ctx is done first,
+// the caller stops waiting and is not referencing the new record.
+func (c *Cache) wait(ctx context.Context, cl *call) (*Record, error) {
+	select {
+	case <-cl.done:
+	case <-ctx.Done():
+		c.mu.Lock()
+		if !cl.finished {
+			cl.waiters--
+			c.mu.Unlock()
+			return nil, context.Cause(ctx)
+		}
+		c.mu.Unlock()
+		// The record was created on behalf of the caller.
+		<-cl.done
+	}
+
+	if cl.err != nil {
+		return nil, cl.err
+	}
+
+	rec := cl.rec
+	return &rec, nil
+}
+
+// get returns the unexpired record of key at index. An unreachable record
+// is removed from the unreachable map and must be stored as reachable by the caller.
+// Invalid records are deleted. Expired records are left in place for the fetch
+// to replace, so that the replace callback receives the new value, unless the
+// eviction filter vetoes their expiry. Records of colliding keys are left in place.
+func (c *Cache) get(key string, index uint64, now int64) *Record {
+	if rec, ok := c.unreachable[index]; ok {
+		if rec.key != key {
+			return nil
+		}
+		if rec.isExpired(now) {
+			if rec.version != "" || c.isStale(rec, now) || !c.vetoed(index, rec, now) || rec.isExpired(now) {
+				return nil
+			}
+		}
+		if !c.isValid(c.unreachable, index, rec) {
+			return nil
+		}
+		// An unreachable record was found, make it reachable later.
+		delete(c.unreachable, index)
+		c.unreachableBytes -= rec.size
+		return rec
+	} else if rec, ok = c.reachable[index]; ok {
+		if rec.key != key {
+			return nil
+		}
+		if !c.softMaxTTL && rec.isExpired(now) {
+			if rec.version != "" || c.isStale(rec, now) || !c.vetoed(index, rec, now) || rec.isExpired(now) {
+				return nil
+			}
+		}
+		if !c.isValid(c.reachable, index, rec) {
+			return nil
+		}
+		// A reachable record was found.
+		return rec
+	}
+	return nil
+}
+
+// isValid reports whether the value of rec passes the validator.
+// An invalid record is evicted from m.
+func (c *Cache) isValid(m recordMap, index uint64, rec *Record) bool {
+	if c.validate == nil || c.validate(rec.Value) {
+		return true
+	}
+	c.evict(m, index, rec, EvictionInvalidated)
+	return false
+}
+
+// peek returns the unexpired record of key at index
+// without referencing it or moving it between maps.
+func (c *Cache) peek(key string, index uint64, now int64) (*Record, bool) {
+	if rec, ok := c.reachable[index]; ok {
+		if rec.key != key || (!c.softMaxTTL && rec.isExpired(now)) {
+			return nil, false
+		}
+		return rec, true
+	}
+	rec, ok := c.unreachable[index]
+	if !ok || rec.key != key || rec.isExpired(now) {
+		return nil, false
+	}
+	return rec, true
+}
+
+// do runs the fallback of cl without holding the lock and stores the new record.
+// If all waiters have given up, the result is discarded.
+func (c *Cache) do(cl *call, index uint64, weight int64, minTTL, maxTTL time.Duration, fetch fetchTTL) {
+	defer func() {
+		if !cl.finished {
+			// The fallback exited the goroutine, release the waiters.
+			c.mu.Lock()
+			cl.finished = true
+			delete(c.calls, index)
+			c.mu.Unlock()
+			cl.err = ErrFetchPanicked
+		}
+		close(cl.done)
+	}()
+
+	value, ttl, err := c.retryFetch(cl, fetch)
+
+	var extras map[string]interface{}
+	if v, ok := value.(withExtras); ok {
+		value, extras = v.value, v.extras
+	}
+
+	var version string
+	if v, ok := value.(versioned); ok {
+		value, version = v.value, v.version
+	}
+
+	c.mu.Lock()
+
+	cl.finished = true
+	delete(c.calls, index)
+
+	if c.closed {
+		// The cache was closed during the fallback.
+		c.unlock()
+		cl.err = ErrClosed
+		if c.autoClose && err == nil {
+			// The values are not cached, so Close did not close them.
+			c.closeValue(cl.key, value)
+			for key, extra := range extras {
+				c.closeValue(key, extra)
+			}
+		}
+		return
+	}
+
+	defer c.unlock()
+
+	if errors.Is(err, ErrDoNotCache) {
+		err, ttl = nil, -1
+	}
+
+	if err != nil {
+		if cl.waiters > 0 {
+			if rec, ok := c.serveStale(cl.key, index, cl.waiters); ok {
+				cl.rec = rec
+				return
+			}
+		}
+		cl.err = err
+		return
+	}
+
+	if ttl < 0 || (value == nil && !c.cacheNil) {
+		// Return the value without caching it. The record has
+		// no generation since it is not referenced.
+		cl.rec = Record{
+			Value: value,
+			key:   cl.key,
+		}
+		return
+	}
+
+	if ttl > 0 {
+		maxTTL = ttl
+	}
+
+	now := time.Now().UnixNano()
+	for key, extra := range extras {
+		if key == cl.key {
+			continue
+		}
+		extraIndex := c.index(key)
+		if _, ok := c.peek(key, extraIndex, now); ok {
+			// Keep the unexpired record, which may be referenced.
+			continue
+		}
+		c.insert(key, extraIndex, extra, 0, "", minTTL, maxTTL, 0)
+	}
+
+	if cl.waiters == 0 {
+		return
+	}
+
+	if version != "" {
+		if rec, ok := c.renew(cl.key, index, version, minTTL, maxTTL, cl.waiters); ok {
+			cl.rec = rec
+			return
+		}
+	}
+
+	// Create a new record referenced by all waiters.
+	cl.rec = c.insert(cl.key, index, value, weight, version, minTTL, maxTTL, cl.waiters)
+}
+
+// renew extends the lifetime of the record of key at index if it has the
+// given version, instead of replacing it, and adds refs references to it.
+func (c *Cache) renew(key string, index uint64, version string, minTTL, maxTTL time.Duration, refs uint) (Record, bool) {
+	m := c.reachable
+	rec, ok := m[index]
+	if !ok {
+		m = c.unreachable
+		rec, ok = m[index]
+	}
+	if !ok || rec.key != key || rec.version != version {
+		return Record{}, false
+	}
+
+	now := time.Now()
+
+	if maxTTL > 0 && minTTL > maxTTL {
+		minTTL = maxTTL
+	}
+	rec.minTTL = int64(minTTL)
+	rec.maxTTL = int64(maxTTL)
+	rec.expires = 0
+	if maxTTL > 0 {
+		rec.expires = now.Add(maxTTL).UnixNano()
+	}
+	rec.lastUnref = 0
+	rec.refs += refs
+
+	if c.unreachable[index] == rec {
+		c.unreachableBytes -= rec.size
+	}
+	delete(m, index)
+	c.reachable[index] = rec
+
+	return *rec, true
+}
+
+// isStale reports whether rec is past its maxTTL but may still be served
+// on a failed fetch. A record unreferenced for its minTTL is not served.
+func (c *Cache) isStale(rec *Record, now int64) bool {
+	if c.maxStale <= 0 || rec.expires <= 0 || (rec.lastUnref > 0 && rec.lastUnref+rec.minTTL < now) {
+		return false
+	}
+	return rec.expires < now && now <= rec.expires+int64(c.maxStale)
+}
+
+// serveStale adds refs references to the stale record of key at index
+// after its fetch failed.
+func (c *Cache) serveStale(key string, index uint64, refs uint) (Record, bool) {
+	m := c.reachable
+	rec, ok := m[index]
+	if !ok {
+		m = c.unreachable
+		rec, ok = m[index]
+	}
+	if !ok || rec.key != key || !c.isStale(rec, time.Now().UnixNano()) {
+		return Record{}, false
+	}
+
+	rec.lastUnref = 0
+	rec.refs += refs
+
+	if c.unreachable[index] == rec {
+		c.unreachableBytes -= rec.size
+	}
+	delete(m, index)
+	c.reachable[index] = rec
+
+	return *rec, true
+}
+
+// insert stores a new record with refs references at index, replacing
+// the record of a colliding key. A record with no references is
+// stored as unreachable.
+func (c *Cache) insert(key string, index uint64, value interface{}, weight int64, version string, minTTL, maxTTL time.Duration, refs uint) Record {
+	now := time.Now()
+
+	m := c.reachable
+	old, ok := m[index]
+	if !ok {
+		m = c.unreachable
+		old, ok = m[index]
+	}
+	if ok {
+		c.evict(m, index, old, EvictionReplaced)
+		if old.key == key {
+			c.evicted[len(c.evicted)-1].replacement = value
+		}
+	}
+
+	if maxTTL > 0 && minTTL > maxTTL {
+		// maxTTL is a hard limit.
+		minTTL = maxTTL
+	}
+
+	c.nextGen++
+	rec := &Record{
+		Value:   value,
+		key:     key,
+		gen:     c.nextGen,
+		created: now.UnixNano(),
+		weight:  weight,
+		version: version,
+		minTTL:  int64(minTTL),
+		maxTTL:  int64(maxTTL),
+		refs:    refs,
+	}
+	if maxTTL > 0 {
+		rec.expires = now.Add(maxTTL).UnixNano()
+	}
+	if c.policy == LFU {
+		rec.freq = 1
+		rec.freqTime = now.UnixNano()
+	}
+	if sizer, ok := value.(Sizer); ok {
+		rec.size = sizer.Size()
+	}
+
+	if refs > 0 {
+		c.reachable[index] = rec
+	} else {
+		c.addUnreachable(index, rec, now.UnixNano())
+	}
+
+	c.bytes += rec.size
+	c.stats.weight.Add(rec.weight)
+	c.shrink()
+
+	return *rec
+}
+
+// addUnreachable stores rec in the unreachable map, marking it
+// unreferenced at time now, and queues it for sweeping.
+func (c *Cache) addUnreachable(index uint64, rec *Record, now int64) {
+	// Mark the last unref time so that the record would survive
+	// being unreachable until at least minTTL duration has passed.
+	rec.lastUnref = now
+	c.unreachable[index] = rec
+	c.unreachableBytes += rec.size
+	c.sweepQueued++
+	if c.gcIdle {
+		// Wake up the GC loop from its backoff.
+		c.gcIdle = false
+		select {
+		case c.gcWake <- struct{}{}:
+		default:
+		}
+	}
+	c.sweepQueue = append(c.sweepQueue, sweepItem{
+		index:     index,
+		lastUnref: rec.lastUnref,
+	})
+	if len(c.sweepQueue) > 2*len(c.unreachable)+sweepQueueSlack {
+		// Records revived or replaced since they were queued
+		// are only dropped by sweeps, which may not be running.
+		c.sweepQueue = c.validSweepItems(c.sweepQueue[:0])
+	}
+}
+
+// validSweepItems appends the items of the sweep queue whose records are
+// still unreachable since they were queued to queue and returns the result.
+// queue may share the backing array of the sweep queue.
+func (c *Cache) validSweepItems(queue []sweepItem) []sweepItem {
+	for _, item := range c.sweepQueue {
+		if rec, ok := c.unreachable[item.index]; ok && rec.lastUnref == item.lastUnref {
+			queue = append(queue, item)
+		}
+	}
+	return queue
+}
+
+// setFinalizer sets a finalizer on the unique pointer rec which unrefs
+// the record at index when the pointer gets garbage collected.
+func (c *Cache) setFinalizer(index uint64, rec *Record) {
+	gen := rec.gen
+	runtime.SetFinalizer(rec, func(_ interface{}) {
+		c.queueUnref(index, gen)
+	})
+}
+
+// retryFetch calls the fallback of cl until it succeeds, up to
+// c.fetchAttempts times, waiting for c.fetchBackoff between the attempts.
+// The retries stop when all waiters of cl have given up, when the cache is
+// closed or, with WithFetchTimeout, when the timeout has passed since the
+// first attempt. A panic or ErrDoNotCache is not retried.
+func (c *Cache) retryFetch(cl *call, fetch fetchTTL) (interface{}, time.Duration, error) {
+	ctx := c.ctx
+	if c.fetchAttempts > 1 && c.fetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.fetchTimeout)
+		defer cancel()
+	}
+
+	for attempt := 1; ; attempt++ {
+		value, ttl, err := c.runFetch(fetch)
+		if err == nil || attempt >= c.fetchAttempts || errors.Is(err, ErrFetchPanicked) || errors.Is(err, ErrDoNotCache) {
+			return value, ttl, err
+		}
+
+		if c.fetchBackoff != nil && c.hasWaiters(cl) {
+			timer := time.NewTimer(c.fetchBackoff(attempt))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+
+		if ctx.Err() != nil || !c.hasWaiters(cl) {
+			return value, ttl, err
+		}
+	}
+}
+
+// hasWaiters reports whether any caller still waits for cl.
+func (c *Cache) hasWaiters(cl *call) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return cl.waiters > 0
+}
+
+// runFetch calls the fallback, limiting the number of concurrent fallbacks.
+// A panic in the fallback is returned as an error.
+func (c *Cache) runFetch(fetch fetchTTL) (value interface{}, ttl time.Duration, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			value, ttl, err = nil, 0, fmt.Errorf("%w: %v", ErrFetchPanicked, r)
+		}
+	}()
+
+	if c.fetchSem != nil {
+		if c.failFast {
+			select {
+			case c.fetchSem <- struct{}{}:
+			default:
+				return nil, 0, ErrTooManyFetches
+			}
+		} else {
+			c.fetchSem <- struct{}{}
+		}
+		defer func() {
+			<-c.fetchSem
+		}()
+	}
+
+	if !c.fetchLatency {
+		return fetch()
+	}
+
+	start := time.Now()
+	value, ttl, err = fetch()
+	c.stats.addFetch(time.Since(start))
+
+	return value, ttl, err
+}
+
+// hit references rec, the record of key at index returned by get,
+// and returns a copy of it. The copy is returned only to the caller
+// so that the caller triggers a finalizer when the pointer is garbage collected.
+func (c *Cache) hit(key string, index uint64, rec *Record) *Record {
+	c.stats.addHit(key)
+	c.ref(rec)
+	if c.slidingGrace {
+		// The minTTL grace period starts again from the next unref.
+		rec.lastUnref = 0
+	}
+	if c.slidingMaxTTL && rec.maxTTL > 0 {
+		rec.expires = time.Now().UnixNano() + rec.maxTTL
+	}
+	if c.policy == LFU {
+		now := time.Now().UnixNano()
+		rec.freq = rec.frequency(now) + 1
+		rec.freqTime = now
+	}
+	c.reachable[index] = rec
+	ref := *rec
+	return &ref
+}
+
+// ref increments the reference count of rec.
+func (c *Cache) ref(rec *Record) {
+	if c.refcountChecks && rec.refs == math.MaxUint {
+		panic(fmt.Sprintf("weakcache: reference count overflow for key %q", rec.key))
+	}
+	rec.refs++
+}
+
+// unref is called when a pointer to a cache record gets garbage collected.
+// gen is the generation of the record the pointer was handed out for.
+func (c *Cache) unref(index uint64, gen uint64) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	if c.closed {
+		// A pointer outlived the cache.
+		c.stats.orphaned.Add(1)
+		return
+	}
+
+	rec, ok := c.reachable[index]
+	if !ok || rec.gen != gen {
+		// The record expired during fetch while having other live pointers
+		// and was deleted or replaced by a new generation.
+		return
+	}
+
+	// Decrease reference count for the record.
+	if c.refcountChecks && rec.refs == 0 {
+		panic(fmt.Sprintf("weakcache: reference count underflow for key %q", rec.key))
+	}
+	rec.refs--
+	if rec.refs == 0 {
 		// No pointers, move to unreachable map.
+		rec.refSince, rec.leaked = 0, false
 		delete(c.reachable, index)
-		// Mark the last unref time so that the record would survive
-		// being unreachable until at least minTTL duration has passed.
-		rec.lastUnref = time.Now().UnixNano()
-		c.unreachable[index] = rec
+		c.addUnreachable(index, rec, time.Now().UnixNano())
+		c.shrink()
 	}
 }
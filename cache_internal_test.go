@@ -0,0 +1,238 @@
+package weakcache
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestRefsStress(t *testing.T) {
+	g := NewWithT(t)
+
+	c := New(WithGCInterval(10 * time.Millisecond))
+	defer c.Close()
+
+	fetch := func() (interface{}, error) {
+		return "value", nil
+	}
+
+	// Fetch and drop the same key from many goroutines. The short maxTTL
+	// makes fetch replace the record while old pointers are still alive.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				rec, err := c.Fetch("key", 0, time.Millisecond, fetch)
+				g.Expect(err).NotTo(HaveOccurred())
+				g.Expect(rec.Value).To(Equal("value"))
+				if j%50 == 0 {
+					runtime.GC()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Let the last record expire and hold a reference to its replacement.
+	time.Sleep(2 * time.Millisecond)
+	held, err := c.Fetch("key", 0, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// Collect all other pointers. Their finalizers must not
+	// decrement the reference count of the new record.
+	for i := 0; i < 5; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	index := c.index("key")
+
+	c.mu.Lock()
+	rec, ok := c.reachable[index]
+	c.mu.Unlock()
+
+	g.Expect(ok).To(BeTrue())
+	g.Expect(rec.refs).To(Equal(uint(1)))
+
+	runtime.KeepAlive(held)
+
+	// The last reference is gone.
+	g.Eventually(func() int {
+		runtime.GC()
+		return c.Len()
+	}).Should(Equal(0))
+}
+
+func TestSeed(t *testing.T) {
+	g := NewWithT(t)
+
+	seed := maphash.MakeSeed()
+
+	c1 := New(WithSeed(seed))
+	defer c1.Close()
+
+	c2 := New(WithSeed(seed))
+	defer c2.Close()
+
+	for _, key := range []string{"", "a", "b", "key", "another key"} {
+		g.Expect(c1.index(key)).To(Equal(c2.index(key)))
+	}
+}
+
+func TestRefcountChecks(t *testing.T) {
+	g := NewWithT(t)
+
+	c := New(WithGCInterval(0), WithRefcountChecks(true))
+	defer c.Close()
+
+	index := c.index("key")
+
+	// Simulate a record whose reference was already released
+	// by an extra unref without being moved to unreachable.
+	c.mu.Lock()
+	c.insert("key", index, "value", 0, "", 0, 0, 1)
+	rec := c.reachable[index]
+	rec.refs = 0
+	c.mu.Unlock()
+
+	recovered := func(fn func()) (r interface{}) {
+		defer func() {
+			r = recover()
+		}()
+		fn()
+		return nil
+	}
+
+	g.Expect(recovered(func() {
+		c.unref(index, rec.gen)
+	})).To(Equal(`weakcache: reference count underflow for key "key"`))
+
+	g.Expect(c.reachable[index].refs).To(BeZero())
+
+	rec.refs = math.MaxUint
+	g.Expect(recovered(func() {
+		c.ref(rec)
+	})).To(Equal(`weakcache: reference count overflow for key "key"`))
+}
+
+func TestLenConcurrent(t *testing.T) {
+	g := NewWithT(t)
+
+	c := New(WithGCInterval(time.Millisecond))
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	for i := 0; i < 4; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				rec, err := c.Fetch(fmt.Sprintf("key%d", (i*1000+j)%300), time.Duration(j%3)*time.Millisecond, 0, func() (interface{}, error) {
+					return j, nil
+				})
+				if err != nil {
+					panic(err)
+				}
+				runtime.KeepAlive(rec)
+			}
+		}()
+	}
+
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				reachable, unreachable := c.Counts()
+				if reachable < 0 || unreachable < 0 || c.Len() < 0 {
+					panic("negative count")
+				}
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	// Stop sweeping while comparing the counts.
+	c.Pause()
+	c.Sync()
+
+	c.mu.Lock()
+	reachable, unreachable := len(c.reachable), len(c.unreachable)
+	c.mu.Unlock()
+
+	r, u := c.Counts()
+	g.Expect(r).To(Equal(reachable))
+	g.Expect(u).To(Equal(unreachable))
+	g.Expect(c.Len()).To(Equal(reachable + unreachable))
+}
+
+func TestVerifyViolations(t *testing.T) {
+	g := NewWithT(t)
+
+	c := New(WithGCInterval(0))
+	defer c.Close()
+
+	index := c.index("key")
+
+	c.mu.Lock()
+	c.insert("key", index, "value", 0, "", time.Minute, 0, 1)
+	c.mu.Unlock()
+
+	g.Expect(c.Verify()).To(Succeed())
+
+	c.mu.Lock()
+	c.reachable[index].refs = 0
+	c.mu.Unlock()
+
+	g.Expect(c.Verify()).To(MatchError(`weakcache: reachable key "key" has no references`))
+
+	c.mu.Lock()
+	c.unreachable[index] = c.reachable[index]
+	c.mu.Unlock()
+
+	g.Expect(c.Verify()).To(MatchError(`weakcache: key "key" is both reachable and unreachable`))
+
+	c.mu.Lock()
+	delete(c.reachable, index)
+	c.mu.Unlock()
+
+	g.Expect(c.Verify()).To(MatchError(`weakcache: unreachable key "key" has no unreference time`))
+
+	swept := New(WithGCInterval(0))
+	defer swept.Close()
+
+	swept.mu.Lock()
+	swept.insert("key", swept.index("key"), "value", 0, "", 0, 0, 0)
+	now := time.Now().UnixNano() + 1
+	swept.sweep(now)
+	swept.unlock()
+
+	g.Expect(swept.Verify()).To(Succeed())
+	g.Expect(swept.Len()).To(Equal(0))
+
+	// A record which the sweep failed to evict.
+	swept.mu.Lock()
+	swept.insert("key", swept.index("key"), "value", 0, "", 0, 0, 0)
+	swept.lastSweep = time.Now().UnixNano() + 1
+	swept.mu.Unlock()
+
+	g.Expect(swept.Verify()).To(MatchError(`weakcache: expired key "key" remains after a sweep`))
+}
@@ -1,7 +1,13 @@
 package weakcache_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,7 +18,7 @@ import (
 func TestGCEviction(t *testing.T) {
 	g := NewWithT(t)
 
-	cache := weakcache.New(10 * time.Millisecond)
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
 	defer cache.Close()
 
 	// Fetch an item with 0 minTTL and 0 maxTTL.
@@ -36,12 +42,86 @@ func TestGCEviction(t *testing.T) {
 	}).Should(Equal(0))
 }
 
+func TestSync(t *testing.T) {
+	g := NewWithT(t)
+
+	// Disable the GC loop so that the unreachable record is not swept.
+	cache := weakcache.New(weakcache.WithGCInterval(0))
+	defer cache.Close()
+
+	rec, _ := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+
+	g.Expect(rec.Value).To(Equal("value"))
+
+	runtime.KeepAlive(rec)
+
+	runtime.GC()
+	cache.Sync()
+
+	reachable, unreachable := cache.Counts()
+	g.Expect(reachable).To(Equal(0))
+	g.Expect(unreachable).To(Equal(1))
+}
+
+func TestFetchSoft(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(0))
+	defer cache.Close()
+
+	soft, _ := cache.FetchSoft("soft", 0, func() (interface{}, error) {
+		return "value", nil
+	})
+	hard, _ := cache.Fetch("hard", time.Minute, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+
+	runtime.KeepAlive(soft)
+	runtime.KeepAlive(hard)
+	cache.Sync()
+
+	g.Expect(cache.Len()).To(Equal(2))
+
+	// The soft record is reaped on the next GC tick.
+	cache.SetGCInterval(10 * time.Millisecond)
+
+	g.Eventually(func() bool {
+		_, ok := cache.State("soft")
+		return ok
+	}).Should(BeFalse())
+
+	g.Expect(cache.Contains("hard")).To(BeTrue())
+}
+
+func TestFetchValue(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	value, err := cache.FetchValue("key", 0, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(value).To(Equal("value"))
+
+	// The record is not referenced after FetchValue returns.
+	reachable, _ := cache.Counts()
+	g.Expect(reachable).To(Equal(0))
+
+	g.Eventually(func() int {
+		return cache.Len()
+	}).Should(Equal(0))
+}
+
 func TestMinTTL(t *testing.T) {
 	g := NewWithT(t)
 
 	// minTTL specifies how long the item will survive being unreferenced.
 
-	cache := weakcache.New(10 * time.Millisecond)
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
 	defer cache.Close()
 
 	// Fetch an item with minTTL set.
@@ -90,7 +170,7 @@ func TestMinTTL(t *testing.T) {
 func TestMaxTTL(t *testing.T) {
 	g := NewWithT(t)
 
-	cache := weakcache.New(10 * time.Millisecond)
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
 	defer cache.Close()
 
 	// Fetch an item with minTTL set.
@@ -129,3 +209,1728 @@ func TestMaxTTL(t *testing.T) {
 	runtime.KeepAlive(rec2)
 	runtime.KeepAlive(rec1)
 }
+
+func TestTTLPrecedence(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		minTTL, maxTTL time.Duration
+		// cached reports whether the unreferenced
+		// record is cached after the sleep.
+		cached bool
+	}{
+		{name: "minTTL larger than maxTTL", minTTL: time.Hour, maxTTL: 100 * time.Millisecond, cached: false},
+		{name: "minTTL only", minTTL: time.Hour, cached: true},
+		{name: "maxTTL only", maxTTL: time.Hour, cached: false},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+			defer cache.Close()
+
+			rec, err := cache.Fetch("key", tc.minTTL, tc.maxTTL, func() (interface{}, error) {
+				return "value", nil
+			})
+			g.Expect(err).NotTo(HaveOccurred())
+
+			runtime.KeepAlive(rec)
+			cache.Sync()
+
+			time.Sleep(150 * time.Millisecond)
+
+			g.Expect(cache.Contains("key")).To(Equal(tc.cached))
+		})
+	}
+}
+
+func TestForEach(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	var recs []*weakcache.Record
+	for i := 0; i < 10; i++ {
+		i := i
+		rec, _ := cache.Fetch(fmt.Sprintf("key%d", i), 0, 0, func() (interface{}, error) {
+			return i, nil
+		})
+		recs = append(recs, rec)
+	}
+
+	// Count the records with an even value.
+	even := 0
+	cache.ForEach(func(key string, value interface{}) bool {
+		g.Expect(key).To(Equal(fmt.Sprintf("key%d", value)))
+		if value.(int)%2 == 0 {
+			even++
+		}
+		return true
+	})
+
+	g.Expect(even).To(Equal(5))
+
+	// Stop the iteration early.
+	visited := 0
+	cache.ForEach(func(key string, value interface{}) bool {
+		visited++
+		return visited < 3
+	})
+
+	g.Expect(visited).To(Equal(3))
+
+	runtime.KeepAlive(recs)
+}
+
+func TestRange(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	recs := map[string]*weakcache.Record{}
+	for _, key := range []string{"a", "b"} {
+		key := key
+		rec, err := cache.Fetch(key, 0, 0, func() (interface{}, error) {
+			return key, nil
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		recs[key] = rec
+	}
+
+	var keys []string
+	cache.Range(func(key string, rec *weakcache.Record) bool {
+		keys = append(keys, key)
+
+		// Drop the other reference. The record
+		// is kept alive by the Range reference.
+		delete(recs, key)
+		cache.Sync()
+
+		state, ok := cache.State(key)
+		g.Expect(ok).To(BeTrue())
+		g.Expect(state).To(Equal(weakcache.Reachable))
+		g.Expect(rec.Value).To(Equal(key))
+
+		return true
+	})
+
+	g.Expect(keys).To(ConsistOf("a", "b"))
+
+	cache.Sync()
+
+	g.Eventually(func() int {
+		return cache.Len()
+	}).Should(Equal(0))
+}
+
+func TestContains(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	g.Expect(cache.Contains("key")).To(BeFalse())
+
+	rec, _ := cache.Fetch("key", 100*time.Millisecond, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+
+	g.Expect(rec.Value).To(Equal("value"))
+
+	g.Expect(cache.Contains("key")).To(BeTrue())
+	g.Expect(cache.Contains("other")).To(BeFalse())
+
+	runtime.KeepAlive(rec)
+
+	runtime.GC()
+
+	// Contains does not reference the record, so it does not
+	// extend the minTTL grace period of the unreachable record.
+	start := time.Now()
+	g.Eventually(func() bool {
+		return cache.Contains("key")
+	}).Should(BeFalse())
+
+	g.Expect(time.Since(start)).To(BeNumerically("<", 200*time.Millisecond))
+
+	g.Eventually(func() int {
+		return cache.Len()
+	}).Should(Equal(0))
+}
+
+func TestCounts(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	rec1, _ := cache.Fetch("key1", time.Minute, 0, func() (interface{}, error) {
+		return "value1", nil
+	})
+	rec2, _ := cache.Fetch("key2", time.Minute, 0, func() (interface{}, error) {
+		return "value2", nil
+	})
+
+	g.Expect(rec1.Value).To(Equal("value1"))
+	g.Expect(rec2.Value).To(Equal("value2"))
+
+	reachable, unreachable := cache.Counts()
+	g.Expect(reachable).To(Equal(2))
+	g.Expect(unreachable).To(Equal(0))
+
+	runtime.KeepAlive(rec2)
+
+	runtime.GC()
+
+	// rec2 was collected and its record is kept alive by minTTL.
+	g.Eventually(func() []int {
+		reachable, unreachable := cache.Counts()
+		return []int{reachable, unreachable}
+	}).Should(Equal([]int{1, 1}))
+
+	runtime.KeepAlive(rec1)
+}
+
+func TestFetchAsync(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	var calls int32
+	fetch := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		return "value", nil
+	}
+
+	var results []<-chan weakcache.FetchResult
+	for i := 0; i < 10; i++ {
+		results = append(results, cache.FetchAsync("key", 0, 0, fetch))
+	}
+
+	errFetch := errors.New("fetch failed")
+	failed := cache.FetchAsync("other", 0, 0, func() (interface{}, error) {
+		return nil, errFetch
+	})
+
+	var recs []*weakcache.Record
+	for _, ch := range results {
+		res := <-ch
+		g.Expect(res.Err).NotTo(HaveOccurred())
+		g.Expect(res.Record.Value).To(Equal("value"))
+		recs = append(recs, res.Record)
+
+		// The channel is closed after the result.
+		_, ok := <-ch
+		g.Expect(ok).To(BeFalse())
+	}
+
+	res := <-failed
+	g.Expect(res.Err).To(MatchError(errFetch))
+	g.Expect(res.Record).To(BeNil())
+
+	// Concurrent fetches of the same key share a single fallback.
+	g.Expect(atomic.LoadInt32(&calls)).To(Equal(int32(1)))
+
+	g.Expect(cache.Len()).To(Equal(1))
+
+	runtime.KeepAlive(recs)
+
+	runtime.GC()
+
+	// All references were released.
+	g.Eventually(func() int {
+		return cache.Len()
+	}).Should(Equal(0))
+}
+
+func TestAge(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	rec1, _ := cache.Fetch("key", time.Minute, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+
+	g.Expect(rec1.Age(time.Now())).To(BeNumerically("<", 20*time.Millisecond))
+
+	time.Sleep(50 * time.Millisecond)
+
+	g.Expect(rec1.Age(time.Now())).To(BeNumerically(">=", 50*time.Millisecond))
+
+	runtime.KeepAlive(rec1)
+
+	runtime.GC()
+
+	g.Eventually(func() int {
+		_, unreachable := cache.Counts()
+		return unreachable
+	}).Should(Equal(1))
+
+	time.Sleep(50 * time.Millisecond)
+
+	// Reviving the unreachable record preserves its creation time.
+	rec2, _ := cache.Fetch("key", time.Minute, 0, func() (interface{}, error) {
+		panic("unexpected fetch fallback")
+	})
+
+	g.Expect(rec2.Age(time.Now())).To(BeNumerically(">=", 100*time.Millisecond))
+}
+
+func TestCloseContext(t *testing.T) {
+	g := NewWithT(t)
+
+	var evicted int32
+	started := make(chan struct{}, 100)
+	release := make(chan struct{})
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithEvictionCallback(func(key string, value interface{}) {
+			started <- struct{}{}
+			<-release
+			atomic.AddInt32(&evicted, 1)
+		}),
+	)
+
+	for i := 0; i < 100; i++ {
+		rec, _ := cache.Fetch(fmt.Sprintf("key%d", i), 0, 0, func() (interface{}, error) {
+			return "value", nil
+		})
+		g.Expect(rec.Value).To(Equal("value"))
+	}
+
+	runtime.GC()
+
+	// Wait until the GC loop is running the eviction callback.
+	<-started
+
+	done := make(chan error)
+	go func() {
+		done <- cache.CloseContext(context.Background())
+	}()
+
+	// CloseContext waits for the callback to complete.
+	g.Consistently(done, 50*time.Millisecond).ShouldNot(Receive())
+
+	close(release)
+
+	g.Eventually(done).Should(Receive(BeNil()))
+
+	// Every evicted record has been notified about.
+	g.Expect(atomic.LoadInt32(&evicted)).To(Equal(int32(100 - cache.Len())))
+}
+
+func TestCloseContextDeadline(t *testing.T) {
+	g := NewWithT(t)
+
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithEvictionCallback(func(key string, value interface{}) {
+			started <- struct{}{}
+			<-release
+		}),
+	)
+
+	rec, _ := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+
+	g.Expect(rec.Value).To(Equal("value"))
+
+	runtime.KeepAlive(rec)
+
+	runtime.GC()
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	g.Expect(cache.CloseContext(ctx)).To(MatchError(context.DeadlineExceeded))
+}
+
+func TestInvalidatePrefix(t *testing.T) {
+	g := NewWithT(t)
+
+	evicted := &evictedKeys{}
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSyncEviction(),
+		weakcache.WithEvictionCallback(evicted.add),
+	)
+	defer cache.Close()
+
+	keys := []string{
+		"user:1:profile",
+		"user:1:settings",
+		"user:12:profile",
+		"user:2:profile",
+	}
+
+	recs := make(map[string]*weakcache.Record)
+	for _, key := range keys {
+		rec, _ := cache.Fetch(key, time.Minute, 0, func() (interface{}, error) {
+			return "value", nil
+		})
+		recs[key] = rec
+	}
+
+	// Let one of the records become unreachable.
+	delete(recs, keys[0])
+
+	runtime.GC()
+
+	g.Eventually(func() int {
+		_, unreachable := cache.Counts()
+		return unreachable
+	}).Should(Equal(1))
+
+	g.Expect(cache.InvalidatePrefix("user:1:")).To(Equal(2))
+
+	g.Expect(cache.Len()).To(Equal(2))
+	g.Expect(cache.Contains("user:12:profile")).To(BeTrue())
+	g.Expect(cache.Contains("user:2:profile")).To(BeTrue())
+	g.Expect(evicted.get()).To(ConsistOf("user:1:profile", "user:1:settings"))
+
+	runtime.KeepAlive(recs)
+}
+
+func TestInvalidateFunc(t *testing.T) {
+	g := NewWithT(t)
+
+	type value struct {
+		version int
+	}
+
+	evicted := &evictedKeys{}
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSyncEviction(),
+		weakcache.WithEvictionCallback(evicted.add),
+	)
+	defer cache.Close()
+
+	var recs []*weakcache.Record
+	for i := 0; i < 6; i++ {
+		v := value{version: i % 3}
+		rec, _ := cache.Fetch(fmt.Sprintf("key%d", i), 0, 0, func() (interface{}, error) {
+			return v, nil
+		})
+		recs = append(recs, rec)
+	}
+
+	// Evict the stale versions.
+	n := cache.InvalidateFunc(func(key string, v interface{}) bool {
+		return v.(value).version < 2
+	})
+
+	g.Expect(n).To(Equal(4))
+	g.Expect(evicted.get()).To(ConsistOf("key0", "key1", "key3", "key4"))
+	g.Expect(cache.Len()).To(Equal(2))
+	g.Expect(cache.Contains("key2")).To(BeTrue())
+	g.Expect(cache.Contains("key5")).To(BeTrue())
+
+	runtime.KeepAlive(recs)
+}
+
+func TestStats(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	for i := 0; i < 3; i++ {
+		rec, _ := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+			return "value", nil
+		})
+		g.Expect(rec.Value).To(Equal("value"))
+		runtime.KeepAlive(rec)
+	}
+
+	stats := cache.Stats()
+	g.Expect(stats.Hits).To(Equal(uint64(2)))
+	g.Expect(stats.Misses).To(Equal(uint64(1)))
+	g.Expect(stats.Evictions).To(Equal(uint64(0)))
+
+	runtime.GC()
+
+	g.Eventually(func() uint64 {
+		return cache.Stats().Evictions
+	}).Should(Equal(uint64(1)))
+}
+
+func TestGet(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	rec, ok := cache.Get("key")
+	g.Expect(ok).To(BeFalse())
+	g.Expect(rec).To(BeNil())
+
+	fetched, err := cache.Fetch("key", time.Minute, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	rec, ok = cache.Get("key")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(rec.Value).To(Equal("value"))
+
+	runtime.KeepAlive(fetched)
+	runtime.GC()
+
+	// The record stays reachable while the reference from Get is held.
+	g.Consistently(func() int {
+		reachable, _ := cache.Counts()
+		return reachable
+	}, 100*time.Millisecond).Should(Equal(1))
+
+	runtime.KeepAlive(rec)
+	runtime.GC()
+
+	g.Eventually(func() int {
+		_, unreachable := cache.Counts()
+		return unreachable
+	}).Should(Equal(1))
+}
+
+func TestLoadOrStore(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	rec1, loaded := cache.LoadOrStore("key", "value", 0, 0)
+	g.Expect(loaded).To(BeFalse())
+	g.Expect(rec1.Value).To(Equal("value"))
+
+	rec2, loaded := cache.LoadOrStore("key", "other value", 0, 0)
+	g.Expect(loaded).To(BeTrue())
+	g.Expect(rec2.Value).To(Equal("value"))
+
+	rec3, _ := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+		panic("unexpected fetch fallback")
+	})
+	g.Expect(rec3.Value).To(Equal("value"))
+
+	g.Expect(cache.Len()).To(Equal(1))
+
+	runtime.KeepAlive(rec1)
+	runtime.KeepAlive(rec2)
+	runtime.KeepAlive(rec3)
+
+	runtime.GC()
+
+	// The stored record is reference-counted like a fetched one.
+	g.Eventually(func() int {
+		return cache.Len()
+	}).Should(Equal(0))
+}
+
+func TestStore(t *testing.T) {
+	g := NewWithT(t)
+
+	var evicted []interface{}
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSyncEviction(),
+		weakcache.WithEvictionCallback(func(key string, value interface{}) {
+			evicted = append(evicted, value)
+		}),
+	)
+	defer cache.Close()
+
+	rec1, _ := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+		return "old value", nil
+	})
+	g.Expect(rec1.Value).To(Equal("old value"))
+
+	rec2 := cache.Store("key", "new value", 0, 0)
+	g.Expect(rec2.Value).To(Equal("new value"))
+
+	g.Expect(evicted).To(Equal([]interface{}{"old value"}))
+	g.Expect(cache.Len()).To(Equal(1))
+
+	rec3, _ := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+		panic("unexpected fetch fallback")
+	})
+	g.Expect(rec3.Value).To(Equal("new value"))
+
+	// The pointer to the replaced record keeps its value.
+	g.Expect(rec1.Value).To(Equal("old value"))
+
+	runtime.KeepAlive(rec1)
+	runtime.KeepAlive(rec2)
+	runtime.KeepAlive(rec3)
+}
+
+func TestInvalidateMulti(t *testing.T) {
+	g := NewWithT(t)
+
+	evicted := &evictedKeys{}
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSyncEviction(),
+		weakcache.WithEvictionCallback(evicted.add),
+	)
+	defer cache.Close()
+
+	var recs []*weakcache.Record
+	for i := 0; i < 5; i++ {
+		rec, _ := cache.Fetch(fmt.Sprintf("key%d", i), time.Minute, 0, func() (interface{}, error) {
+			return i, nil
+		})
+		recs = append(recs, rec)
+	}
+
+	n := cache.InvalidateMulti([]string{"key0", "key2", "key4", "missing"})
+	g.Expect(n).To(Equal(3))
+	g.Expect(cache.Len()).To(Equal(2))
+
+	g.Expect(evicted.get()).To(ConsistOf("key0", "key2", "key4"))
+
+	// Unrefs of the invalidated records are no-ops.
+	recs = nil
+	runtime.KeepAlive(recs)
+	cache.Sync()
+
+	g.Expect(cache.Len()).To(Equal(2))
+}
+
+func TestPauseResume(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	cache.Pause()
+	cache.Pause()
+
+	rec, _ := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+	runtime.KeepAlive(rec)
+	cache.Sync()
+
+	// The unreachable record is not swept while paused.
+	g.Consistently(func() int {
+		return cache.Len()
+	}, 50*time.Millisecond).Should(Equal(1))
+
+	cache.Resume()
+	cache.Resume()
+
+	g.Eventually(func() int {
+		return cache.Len()
+	}).Should(Equal(0))
+
+	cache.Pause()
+	cache.Close()
+
+	// Resume after Close does not start the GC loop.
+	cache.Resume()
+	g.Expect(cache.CloseContext(context.Background())).To(Succeed())
+}
+
+func TestSetGCInterval(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(time.Hour))
+	defer cache.Close()
+
+	drop := func(key string) {
+		rec, _ := cache.Fetch(key, 0, 0, func() (interface{}, error) {
+			return "value", nil
+		})
+		g.Expect(rec.Value).To(Equal("value"))
+		runtime.KeepAlive(rec)
+		runtime.GC()
+
+		g.Eventually(func() int {
+			_, unreachable := cache.Counts()
+			return unreachable
+		}).Should(Equal(1))
+	}
+
+	// The record is not swept within the hourly interval.
+	drop("key1")
+
+	g.Consistently(func() int {
+		return cache.Len()
+	}, 50*time.Millisecond).Should(Equal(1))
+
+	cache.SetGCInterval(10 * time.Millisecond)
+
+	g.Eventually(func() int {
+		return cache.Len()
+	}).Should(Equal(0))
+
+	// Pause the GC loop.
+	cache.SetGCInterval(0)
+
+	drop("key2")
+
+	g.Consistently(func() int {
+		return cache.Len()
+	}, 50*time.Millisecond).Should(Equal(1))
+
+	cache.SetGCInterval(10 * time.Millisecond)
+
+	g.Eventually(func() int {
+		return cache.Len()
+	}).Should(Equal(0))
+}
+
+func TestSetGCIntervalStartsLoop(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(0))
+	defer cache.Close()
+
+	rec, _ := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+	g.Expect(rec.Value).To(Equal("value"))
+	runtime.KeepAlive(rec)
+
+	runtime.GC()
+
+	g.Consistently(func() int {
+		return cache.Len()
+	}, 50*time.Millisecond).Should(Equal(1))
+
+	cache.SetGCInterval(10 * time.Millisecond)
+
+	g.Eventually(func() int {
+		return cache.Len()
+	}).Should(Equal(0))
+}
+
+func TestFetchTTL(t *testing.T) {
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	fetchCount := func(g *WithT, key string, maxTTL, ttl time.Duration) int {
+		calls := 0
+		rec, err := cache.FetchTTL(key, time.Minute, maxTTL, func() (interface{}, time.Duration, error) {
+			calls++
+			return "value", ttl, nil
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(rec.Value).To(Equal("value"))
+		return calls
+	}
+
+	t.Run("override", func(t *testing.T) {
+		g := NewWithT(t)
+
+		// The returned ttl overrides the unlimited maxTTL.
+		g.Expect(fetchCount(g, "override", 0, 50*time.Millisecond)).To(Equal(1))
+		g.Expect(fetchCount(g, "override", 0, 50*time.Millisecond)).To(Equal(0))
+
+		time.Sleep(60 * time.Millisecond)
+
+		g.Expect(fetchCount(g, "override", 0, 50*time.Millisecond)).To(Equal(1))
+	})
+
+	t.Run("fall-through", func(t *testing.T) {
+		g := NewWithT(t)
+
+		// A zero ttl uses maxTTL.
+		g.Expect(fetchCount(g, "fall-through", 50*time.Millisecond, 0)).To(Equal(1))
+		g.Expect(fetchCount(g, "fall-through", 50*time.Millisecond, 0)).To(Equal(0))
+
+		time.Sleep(60 * time.Millisecond)
+
+		g.Expect(fetchCount(g, "fall-through", 50*time.Millisecond, 0)).To(Equal(1))
+	})
+
+	t.Run("do-not-cache", func(t *testing.T) {
+		g := NewWithT(t)
+
+		// A negative ttl returns the value without caching it.
+		g.Expect(fetchCount(g, "do-not-cache", 0, -1)).To(Equal(1))
+		g.Expect(cache.Contains("do-not-cache")).To(BeFalse())
+		g.Expect(fetchCount(g, "do-not-cache", 0, -1)).To(Equal(1))
+	})
+}
+
+func TestFetchAfterClose(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+
+	rec1, _ := cache.Fetch("key1", 0, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+	g.Expect(rec1.Value).To(Equal("value"))
+
+	cache.Close()
+
+	// Close is idempotent.
+	cache.Close()
+
+	rec2, err := cache.Fetch("key2", 0, 0, func() (interface{}, error) {
+		panic("unexpected fetch fallback")
+	})
+	g.Expect(err).To(MatchError(weakcache.ErrClosed))
+	g.Expect(rec2).To(BeNil())
+
+	rec3, err := cache.Fetch("key1", 0, 0, func() (interface{}, error) {
+		panic("unexpected fetch fallback")
+	})
+	g.Expect(err).To(MatchError(weakcache.ErrClosed))
+	g.Expect(rec3).To(BeNil())
+
+	g.Expect(cache.Store("key2", "value", 0, 0)).To(BeNil())
+	g.Expect(cache.InvalidatePrefix("key")).To(Equal(0))
+
+	g.Expect(cache.Len()).To(Equal(1))
+
+	runtime.KeepAlive(rec1)
+}
+
+func TestGCStats(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(time.Hour))
+	defer cache.Close()
+
+	// Restore expired records without running the GC loop.
+	var entries []weakcache.Entry
+	for i := 0; i < 100; i++ {
+		entries = append(entries, weakcache.Entry{
+			Key:   fmt.Sprintf("key%d", i),
+			Value: "value",
+		})
+	}
+	cache.Restore(entries)
+
+	g.Expect(cache.Stats().Swept).To(Equal(uint64(0)))
+
+	time.Sleep(time.Millisecond)
+	cache.SetGCInterval(10 * time.Millisecond)
+
+	g.Eventually(func() int {
+		return cache.Len()
+	}).Should(Equal(0))
+
+	stats := cache.Stats()
+	g.Expect(stats.Swept).To(Equal(uint64(100)))
+	g.Expect(stats.LastGCDuration).To(BeNumerically(">", 0))
+	g.Expect(stats.MaxGCDuration).To(BeNumerically(">=", stats.LastGCDuration))
+}
+
+func TestOrphanedUnrefs(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+
+	rec, _ := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+	g.Expect(rec.Value).To(Equal("value"))
+
+	cache.Close()
+
+	runtime.KeepAlive(rec)
+	cache.Sync()
+
+	// The unref was discarded.
+	g.Expect(cache.Stats().OrphanedUnrefs).To(Equal(uint64(1)))
+	reachable, unreachable := cache.Counts()
+	g.Expect(reachable).To(Equal(1))
+	g.Expect(unreachable).To(Equal(0))
+}
+
+func TestFetchPanic(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	rec1, err := cache.Fetch("key1", 0, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	rec2, err := cache.Fetch("key2", 0, 0, func() (interface{}, error) {
+		panic("fetch failed")
+	})
+	g.Expect(err).To(MatchError(weakcache.ErrFetchPanicked))
+	g.Expect(err.Error()).To(ContainSubstring("fetch failed"))
+	g.Expect(rec2).To(BeNil())
+
+	// No record was stored for the panicked fallback.
+	g.Expect(cache.Len()).To(Equal(1))
+	g.Expect(cache.Contains("key2")).To(BeFalse())
+
+	runtime.KeepAlive(rec1)
+}
+
+func TestTopKeys(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithKeyStats(true),
+	)
+	defer cache.Close()
+
+	var recs []*weakcache.Record
+	for key, n := range map[string]int{"hot": 10, "warm": 5, "cold": 1} {
+		for i := 0; i < n; i++ {
+			rec, err := cache.Fetch(key, time.Minute, 0, func() (interface{}, error) {
+				return key, nil
+			})
+			g.Expect(err).NotTo(HaveOccurred())
+			recs = append(recs, rec)
+		}
+	}
+
+	g.Expect(cache.TopKeys(2)).To(Equal([]weakcache.KeyStat{
+		{Key: "hot", Hits: 9, Misses: 1},
+		{Key: "warm", Hits: 4, Misses: 1},
+	}))
+
+	runtime.KeepAlive(recs)
+}
+
+func TestState(t *testing.T) {
+	g := NewWithT(t)
+
+	// Disable the GC loop until the unreachable state is checked.
+	cache := weakcache.New(weakcache.WithGCInterval(0))
+	defer cache.Close()
+
+	_, ok := cache.State("key")
+	g.Expect(ok).To(BeFalse())
+
+	rec, _ := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+
+	state, ok := cache.State("key")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(state).To(Equal(weakcache.Reachable))
+
+	runtime.KeepAlive(rec)
+	cache.Sync()
+
+	state, ok = cache.State("key")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(state).To(Equal(weakcache.Unreachable))
+
+	cache.SetGCInterval(10 * time.Millisecond)
+
+	g.Eventually(func() bool {
+		_, ok := cache.State("key")
+		return ok
+	}).Should(BeFalse())
+}
+
+func TestFetchConditional(t *testing.T) {
+	g := NewWithT(t)
+
+	var (
+		mu      sync.Mutex
+		evicted []interface{}
+	)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSyncEviction(),
+		weakcache.WithEvictionCallback(func(key string, value interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			evicted = append(evicted, value)
+		}),
+	)
+	defer cache.Close()
+
+	getEvicted := func() []interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]interface{}(nil), evicted...)
+	}
+
+	fetch := func(value, version string) func() (interface{}, string, error) {
+		return func() (interface{}, string, error) {
+			return value, version, nil
+		}
+	}
+
+	rec1, err := cache.FetchConditional("key", 0, 50*time.Millisecond, fetch("value 1", "v1"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec1.Value).To(Equal("value 1"))
+
+	time.Sleep(80 * time.Millisecond)
+
+	// The version is unchanged, the existing record is kept.
+	rec2, err := cache.FetchConditional("key", 0, 50*time.Millisecond, fetch("value 2", "v1"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec2.Value).To(Equal("value 1"))
+	g.Expect(getEvicted()).To(BeEmpty())
+
+	// The lifetime was extended.
+	g.Expect(cache.Contains("key")).To(BeTrue())
+
+	time.Sleep(80 * time.Millisecond)
+
+	// The version changed, the record is replaced.
+	rec3, err := cache.FetchConditional("key", 0, 50*time.Millisecond, fetch("value 3", "v2"))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec3.Value).To(Equal("value 3"))
+	g.Expect(getEvicted()).To(Equal([]interface{}{"value 1"}))
+
+	runtime.KeepAlive(rec1)
+	runtime.KeepAlive(rec2)
+	runtime.KeepAlive(rec3)
+}
+
+func TestFetchContext(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	type ctxKey struct{}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "ctx value"))
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fetchErr := make(chan error, 1)
+
+	go func() {
+		_, err := cache.FetchContext(ctx, "key", 0, 0, func(ctx context.Context) (interface{}, error) {
+			close(started)
+			<-release
+			// The fallback context has the values of the caller's
+			// context but is not canceled with it.
+			g.Expect(ctx.Value(ctxKey{})).To(Equal("ctx value"))
+			g.Expect(ctx.Err()).NotTo(HaveOccurred())
+			return "value", nil
+		})
+		fetchErr <- err
+	}()
+
+	<-started
+	cancel()
+
+	g.Eventually(fetchErr).Should(Receive(MatchError(context.Canceled)))
+
+	close(release)
+
+	// The result is discarded since no caller is waiting for it.
+	g.Consistently(func() int {
+		return cache.Len()
+	}, 50*time.Millisecond).Should(Equal(0))
+}
+
+func BenchmarkFetchHit(b *testing.B) {
+	cache := weakcache.New()
+	defer cache.Close()
+
+	fetch := func() (interface{}, error) {
+		return "value", nil
+	}
+
+	// Hold a reference so that every fetch hits a reachable record.
+	rec, _ := cache.Fetch("key", time.Hour, 0, fetch)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, _ = cache.Fetch("key", time.Hour, 0, fetch)
+	}
+
+	runtime.KeepAlive(rec)
+}
+
+func TestAcquire(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(0), weakcache.WithRefcountChecks(true))
+	defer cache.Close()
+
+	fetch := func() (interface{}, error) {
+		return "value", nil
+	}
+
+	recA, releaseA, err := cache.Acquire("key", time.Hour, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(recA.Value).To(Equal("value"))
+
+	recB, releaseB, err := cache.Acquire("key", time.Hour, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(recB.Value).To(Equal("value"))
+
+	counts := func() []int {
+		reachable, unreachable := cache.Counts()
+		return []int{reachable, unreachable}
+	}
+
+	// The record stays referenced until each pointer is released.
+	releaseA()
+	g.Expect(counts()).To(Equal([]int{1, 0}))
+
+	// Releasing again has no effect.
+	releaseA()
+	g.Expect(counts()).To(Equal([]int{1, 0}))
+
+	releaseB()
+	g.Expect(counts()).To(Equal([]int{0, 1}))
+
+	// The finalizers do not release the pointers again.
+	runtime.KeepAlive(recA)
+	runtime.KeepAlive(recB)
+	cache.Sync()
+	g.Expect(counts()).To(Equal([]int{0, 1}))
+}
+
+func TestCoalescedWaits(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	fetch := func() (interface{}, error) {
+		close(started)
+		<-release
+		return "value", nil
+	}
+
+	var wg sync.WaitGroup
+	fetchKey := func() {
+		defer wg.Done()
+		rec, err := cache.Fetch("key", 0, 0, fetch)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(rec.Value).To(Equal("value"))
+	}
+
+	wg.Add(1)
+	go fetchKey()
+	<-started
+
+	const waiters = 4
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go fetchKey()
+	}
+
+	// Each fetch counts a miss before waiting for the fallback.
+	g.Eventually(func() uint64 {
+		return cache.Stats().Misses
+	}).Should(Equal(uint64(waiters + 1)))
+
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	stats := cache.Stats()
+	g.Expect(stats.CoalescedWaits).To(Equal(uint64(waiters)))
+	g.Expect(stats.CoalescedWaitDuration).To(BeNumerically(">=", waiters*10*time.Millisecond))
+}
+
+func TestUpdateValue(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	g.Expect(cache.UpdateValue("key", "new value")).To(BeFalse())
+	g.Expect(cache.Len()).To(Equal(0))
+
+	calls := 0
+	fetch := func() (interface{}, error) {
+		calls++
+		return "value", nil
+	}
+
+	rec, err := cache.Fetch("key", time.Minute, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(cache.UpdateValue("key", "new value")).To(BeTrue())
+
+	// The returned record is a copy.
+	g.Expect(rec.Value).To(Equal("value"))
+
+	updated, err := cache.Fetch("key", time.Minute, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(updated.Value).To(Equal("new value"))
+	g.Expect(calls).To(Equal(1))
+
+	state, ok := cache.State("key")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(state).To(Equal(weakcache.Reachable))
+
+	// A closed cache is not modified.
+	cache.Close()
+	g.Expect(cache.UpdateValue("key", "closed value")).To(BeFalse())
+	g.Expect(cache.PeekMulti([]string{"key"})).To(Equal(map[string]interface{}{"key": "new value"}))
+
+	runtime.KeepAlive(rec)
+	runtime.KeepAlive(updated)
+}
+
+func TestDone(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+
+	g.Consistently(cache.Done(), 50*time.Millisecond).ShouldNot(BeClosed())
+
+	cache.Close()
+
+	g.Expect(cache.Done()).To(BeClosed())
+
+	for range cache.Done() {
+		t.Fatal("unexpected value")
+	}
+}
+
+func TestValueReleased(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	type value struct {
+		data []byte
+	}
+
+	var finalized atomic.Bool
+
+	func() {
+		v := &value{data: make([]byte, 1<<20)}
+		runtime.SetFinalizer(v, func(*value) {
+			finalized.Store(true)
+		})
+
+		rec, err := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+			return v, nil
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		runtime.KeepAlive(rec)
+	}()
+
+	cache.Sync()
+
+	g.Eventually(func() int {
+		return cache.Len()
+	}).Should(Equal(0))
+
+	// Nothing in the cache holds the value of the evicted record.
+	g.Eventually(func() bool {
+		cache.Sync()
+		return finalized.Load()
+	}).Should(BeTrue())
+}
+
+func TestPeekMulti(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	a := cache.Store("a", "value a", time.Minute, 0)
+	b := cache.Store("b", "value b", time.Minute, 0)
+	expired := cache.Store("expired", "value", time.Minute, time.Nanosecond)
+
+	time.Sleep(time.Millisecond)
+
+	values := cache.PeekMulti([]string{"a", "missing", "b", "expired"})
+	g.Expect(values).To(Equal(map[string]interface{}{
+		"a": "value a",
+		"b": "value b",
+	}))
+
+	// PeekMulti is not a fetch.
+	g.Expect(cache.Stats().Hits).To(BeZero())
+
+	runtime.KeepAlive(a)
+	runtime.KeepAlive(b)
+	runtime.KeepAlive(expired)
+}
+
+func TestFetchScoped(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithDefaultTTL(time.Minute, 0),
+	)
+	defer cache.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	fetch := func() (interface{}, error) {
+		return "value", nil
+	}
+
+	rec, err := cache.FetchScoped(ctx, "scoped", fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.Value).To(Equal("value"))
+
+	other, err := cache.FetchDefault("other", fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(cache.Contains("scoped")).To(BeTrue())
+
+	cancel()
+
+	g.Eventually(func() bool {
+		return cache.Contains("scoped")
+	}).Should(BeFalse())
+	g.Expect(cache.Contains("other")).To(BeTrue())
+
+	runtime.KeepAlive(rec)
+	runtime.KeepAlive(other)
+}
+
+func TestFetchScopedEvictedFirst(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rec, err := cache.FetchScoped(ctx, "key", func() (interface{}, error) {
+		return "old value", nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// Replacing the record stops watching ctx,
+	// so canceling it does not invalidate the new record.
+	newRec := cache.Store("key", "new value", time.Minute, 0)
+	cancel()
+
+	g.Consistently(func() bool {
+		return cache.Contains("key")
+	}, 50*time.Millisecond).Should(BeTrue())
+
+	runtime.KeepAlive(rec)
+	runtime.KeepAlive(newRec)
+}
+
+func TestVerify(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(time.Millisecond),
+		weakcache.WithSweepLimit(10),
+		weakcache.WithMaxBytes(200),
+	)
+	defer cache.Close()
+
+	var recs []*weakcache.Record
+
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%d", i%50)
+
+		switch i % 5 {
+		case 0:
+			rec, err := cache.Fetch(key, time.Duration(i%3)*time.Millisecond, 0, func() (interface{}, error) {
+				return sizedValue(10), nil
+			})
+			g.Expect(err).NotTo(HaveOccurred())
+			recs = append(recs, rec)
+		case 1:
+			_, err := cache.FetchValue(key, time.Minute, 5*time.Millisecond, func() (interface{}, error) {
+				return "value", nil
+			})
+			g.Expect(err).NotTo(HaveOccurred())
+		case 2:
+			recs = append(recs, cache.Store(key, i, 0, time.Millisecond))
+		case 3:
+			cache.InvalidateMulti([]string{key})
+		case 4:
+			// Drop some of the pointers.
+			recs = recs[len(recs)/2:]
+			cache.Sync()
+		}
+
+		g.Expect(cache.Verify()).To(Succeed())
+	}
+
+	runtime.KeepAlive(recs)
+	recs = nil
+	cache.Sync()
+
+	// Let the GC loop sweep the dropped records.
+	time.Sleep(10 * time.Millisecond)
+
+	g.Expect(cache.Verify()).To(Succeed())
+	g.Expect(cache.Len()).To(Equal(0))
+}
+
+func TestFetchExtras(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	held := cache.Store("d", "value d", time.Minute, 0)
+
+	calls := 0
+	rec, err := cache.FetchExtras("a", time.Minute, 0, func() (interface{}, map[string]interface{}, error) {
+		calls++
+		return "value a", map[string]interface{}{
+			"b": "value b",
+			"c": "value c",
+			"d": "batch value d",
+		}, nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.Value).To(Equal("value a"))
+
+	// Only the fetched and the held records are referenced.
+	reachable, unreachable := cache.Counts()
+	g.Expect(reachable).To(Equal(2))
+	g.Expect(unreachable).To(Equal(2))
+
+	// The held record is kept.
+	g.Expect(cache.PeekMulti([]string{"d"})).To(Equal(map[string]interface{}{"d": "value d"}))
+	g.Expect(cache.Verify()).To(Succeed())
+
+	sibling, err := cache.Fetch("b", time.Minute, 0, func() (interface{}, error) {
+		calls++
+		return "fetched value b", nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(sibling.Value).To(Equal("value b"))
+	g.Expect(calls).To(Equal(1))
+	g.Expect(cache.Stats().Hits).To(Equal(uint64(1)))
+
+	runtime.KeepAlive(rec)
+	runtime.KeepAlive(sibling)
+	runtime.KeepAlive(held)
+}
+
+func TestGCBackoff(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(2 * time.Millisecond))
+	defer cache.Close()
+
+	// An idle loop backs off up to 16 times the interval, so it sweeps
+	// about 10 times in 200ms instead of 100 times.
+	time.Sleep(200 * time.Millisecond)
+	g.Expect(cache.Stats().Sweeps).To(BeNumerically("<", 20))
+
+	// A loop whose sweeps evict nothing backs off too.
+	entries := make(map[string]interface{})
+	for i := 0; i < 100; i++ {
+		entries[fmt.Sprintf("key%d", i)] = i
+	}
+	cache.Preload(entries, time.Minute, 0)
+
+	sweeps := cache.Stats().Sweeps
+	time.Sleep(200 * time.Millisecond)
+	g.Expect(cache.Stats().Sweeps - sweeps).To(BeNumerically("<", 20))
+
+	// An unreachable record wakes up the loop.
+	cache.Store("key", "value", 0, 0)
+	cache.Sync()
+
+	g.Eventually(func() int {
+		return cache.Len()
+	}, 20*time.Millisecond, time.Millisecond).Should(Equal(len(entries)))
+}
+
+func TestRecordID(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(0))
+	defer cache.Close()
+
+	fetch := func() (interface{}, error) {
+		return "value", nil
+	}
+
+	rec, err := cache.Fetch("key", time.Minute, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	id := rec.ID()
+	g.Expect(id).NotTo(BeZero())
+
+	rec = nil
+	cache.Sync()
+	state, _ := cache.State("key")
+	g.Expect(state).To(Equal(weakcache.Unreachable))
+
+	// The revived record keeps its ID.
+	rec, err = cache.Fetch("key", time.Minute, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.ID()).To(Equal(id))
+
+	cache.InvalidateMulti([]string{"key"})
+
+	// A recreated record has a new ID.
+	rec, err = cache.Fetch("key", time.Minute, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.ID()).NotTo(Equal(id))
+
+	runtime.KeepAlive(rec)
+}
+
+func TestCloseDuringFetchContext(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+
+	started := make(chan struct{})
+	causes := make(chan error, 1)
+	fetchErr := make(chan error, 1)
+
+	go func() {
+		_, err := cache.FetchContext(context.Background(), "key", time.Minute, 0, func(ctx context.Context) (interface{}, error) {
+			close(started)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				causes <- context.Cause(ctx)
+			}
+			return "value", nil
+		})
+		fetchErr <- err
+	}()
+
+	<-started
+	cache.Close()
+
+	// The fallback is canceled and its result is discarded.
+	g.Eventually(causes, 100*time.Millisecond).Should(Receive(MatchError(weakcache.ErrClosed)))
+	g.Eventually(fetchErr, 100*time.Millisecond).Should(Receive(MatchError(weakcache.ErrClosed)))
+	g.Expect(cache.Len()).To(Equal(0))
+}
+
+func TestErrDoNotCache(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	calls := 0
+	fetch := func() (interface{}, error) {
+		calls++
+		return "partial value", fmt.Errorf("partial response: %w", weakcache.ErrDoNotCache)
+	}
+
+	for i := 1; i <= 2; i++ {
+		rec, err := cache.Fetch("key", time.Minute, 0, fetch)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(rec.Value).To(Equal("partial value"))
+		g.Expect(rec.ID()).To(BeZero())
+		g.Expect(calls).To(Equal(i))
+		g.Expect(cache.Len()).To(Equal(0))
+	}
+
+	// Nothing is unreferenced for the uncached values.
+	cache.Sync()
+	g.Expect(cache.Verify()).To(Succeed())
+	g.Expect(cache.Stats().OrphanedUnrefs).To(BeZero())
+}
+
+func TestCompact(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(0))
+	defer cache.Close()
+
+	heapAlloc := func() uint64 {
+		var m runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+
+	fetch := func() (interface{}, error) {
+		return "value", nil
+	}
+
+	const size = 100000
+
+	keys := make([]string, size)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		_, err := cache.Fetch(keys[i], time.Minute, 0, fetch)
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+	cache.Sync()
+
+	held, err := cache.Fetch("key0", time.Minute, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// Drain all but two records.
+	g.Expect(cache.InvalidateMulti(keys[2:])).To(Equal(size - 2))
+	cache.Sync()
+
+	before := heapAlloc()
+	cache.Compact()
+	after := heapAlloc()
+
+	// The maps no longer hold the space of the drained records.
+	g.Expect(after).To(BeNumerically("<", before-1<<20))
+
+	// The records are unchanged.
+	g.Expect(cache.Verify()).To(Succeed())
+	state, ok := cache.State("key0")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(state).To(Equal(weakcache.Reachable))
+	state, ok = cache.State("key1")
+	g.Expect(ok).To(BeTrue())
+	g.Expect(state).To(Equal(weakcache.Unreachable))
+
+	runtime.KeepAlive(held)
+	cache.Sync()
+
+	state, _ = cache.State("key0")
+	g.Expect(state).To(Equal(weakcache.Unreachable))
+	g.Expect(cache.Verify()).To(Succeed())
+}
+
+func TestFetchOrError(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(0))
+
+	rec, err := cache.FetchOrError("key")
+	g.Expect(err).To(MatchError(weakcache.ErrNotCached))
+	g.Expect(rec).To(BeNil())
+
+	stored := cache.Store("key", "value", time.Minute, 0)
+
+	rec, err = cache.FetchOrError("key")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.Value).To(Equal("value"))
+
+	// The returned pointer references the record.
+	runtime.KeepAlive(stored)
+	cache.Sync()
+	state, _ := cache.State("key")
+	g.Expect(state).To(Equal(weakcache.Reachable))
+	runtime.KeepAlive(rec)
+
+	cache.Sync()
+	state, _ = cache.State("key")
+	g.Expect(state).To(Equal(weakcache.Unreachable))
+
+	cache.Close()
+
+	_, err = cache.FetchOrError("key")
+	g.Expect(err).To(MatchError(weakcache.ErrClosed))
+}
+
+func TestIndex(t *testing.T) {
+	g := NewWithT(t)
+
+	seed := maphash.MakeSeed()
+
+	c1 := weakcache.New(weakcache.WithSeed(seed))
+	defer c1.Close()
+
+	c2 := weakcache.New(weakcache.WithSeed(seed))
+	defer c2.Close()
+
+	c3 := weakcache.New(weakcache.WithSeed(maphash.MakeSeed()))
+	defer c3.Close()
+
+	g.Expect(c1.Index("key")).To(Equal(c1.Index("key")))
+	g.Expect(c1.Index("key")).To(Equal(c2.Index("key")))
+	g.Expect(c1.Index("key")).NotTo(Equal(c3.Index("key")))
+	g.Expect(c1.Index("key")).NotTo(Equal(c1.Index("other key")))
+}
+
+func TestFetchContextRecursive(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	var fetchKey func(ctx context.Context, key string) (*weakcache.Record, error)
+	fetchKey = func(ctx context.Context, key string) (*weakcache.Record, error) {
+		return cache.FetchContext(ctx, key, time.Minute, 0, func(ctx context.Context) (interface{}, error) {
+			switch key {
+			case "a":
+				// a is derived from b.
+				b, err := fetchKey(ctx, "b")
+				if err != nil {
+					return nil, err
+				}
+				return "a+" + b.Value.(string), nil
+			case "cycle-a":
+				return fetchKey(ctx, "cycle-b")
+			case "cycle-b":
+				return fetchKey(ctx, "cycle-a")
+			default:
+				return key, nil
+			}
+		})
+	}
+
+	rec, err := fetchKey(context.Background(), "a")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.Value).To(Equal("a+b"))
+	g.Expect(cache.Contains("b")).To(BeTrue())
+
+	_, err = fetchKey(context.Background(), "cycle-a")
+	g.Expect(err).To(MatchError(weakcache.ErrFetchCycle))
+	g.Expect(err).To(MatchError(ContainSubstring(`"cycle-a"`)))
+	g.Expect(cache.Contains("cycle-a")).To(BeFalse())
+	g.Expect(cache.Contains("cycle-b")).To(BeFalse())
+
+	runtime.KeepAlive(rec)
+}
+
+func TestFetchRecursive(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	// A fallback may fetch other keys.
+	rec, err := cache.Fetch("a", time.Minute, 0, func() (interface{}, error) {
+		b, err := cache.Fetch("b", time.Minute, 0, func() (interface{}, error) {
+			return "b", nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return "a+" + b.Value.(string), nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.Value).To(Equal("a+b"))
+
+	// A fallback which may fetch its own key must use FetchContext.
+	_, err = cache.FetchContext(context.Background(), "self", time.Minute, 0, func(ctx context.Context) (interface{}, error) {
+		return cache.FetchContext(ctx, "self", time.Minute, 0, func(context.Context) (interface{}, error) {
+			return "self", nil
+		})
+	})
+	g.Expect(err).To(MatchError(weakcache.ErrFetchCycle))
+
+	runtime.KeepAlive(rec)
+}
@@ -0,0 +1,91 @@
+package weakcache
+
+import (
+	"context"
+	"time"
+)
+
+// Clone returns a new independent cache with the configuration and the
+// unexpired records of c. The clone has its own lock, GC loop and stats.
+//
+// Values are shared between the caches, so mutable values are the caller's
+// responsibility. All records start unreferenced in the clone since pointers
+// to records of c do not reference the clone. The clone does not close
+// evicted values even with WithAutoClose, since they are shared with c.
+func (c *Cache) Clone() *Cache {
+	c.loopMu.Lock()
+	gcInterval := c.gcInterval
+	c.loopMu.Unlock()
+
+	clone := &Cache{
+		reachable:      make(recordMap, c.capacity),
+		unreachable:    make(recordMap, c.capacity),
+		calls:          make(map[uint64]*call),
+		fetchTimeout:   c.fetchTimeout,
+		fetchAttempts:  c.fetchAttempts,
+		fetchBackoff:   c.fetchBackoff,
+		maxBytes:       c.maxBytes,
+		failFast:       c.failFast,
+		sweepLimit:     c.sweepLimit,
+		adaptiveSweep:  c.adaptiveSweep,
+		policy:         c.policy,
+		capacity:       c.capacity,
+		maxStale:       c.maxStale,
+		fetchDeadline:  c.fetchDeadline,
+		seed:           c.seed,
+		hash:           c.hash,
+		onEvict:        c.onEvict,
+		onReplace:      c.onReplace,
+		evictFilter:    c.evictFilter,
+		validate:       c.validate,
+		onError:        c.onError,
+		logger:         c.logger,
+		softMaxTTL:     c.softMaxTTL,
+		cacheNil:       c.cacheNil,
+		syncEviction:   c.syncEviction,
+		slidingGrace:   c.slidingGrace,
+		leakThreshold:  c.leakThreshold,
+		slidingMaxTTL:  c.slidingMaxTTL,
+		fetchLatency:   c.fetchLatency,
+		defaultMinTTL:  c.defaultMinTTL,
+		defaultMaxTTL:  c.defaultMaxTTL,
+		refcountChecks: c.refcountChecks,
+		quit:           make(chan struct{}),
+		intervalCh:     make(chan time.Duration),
+		gcWake:         make(chan struct{}, 1),
+	}
+	if c.stats.keys != nil {
+		clone.stats.keys = make(map[string]*KeyStat)
+	}
+	if c.fetchSem != nil {
+		clone.fetchSem = make(chan struct{}, cap(c.fetchSem))
+	}
+	clone.ctx, clone.cancel = context.WithCancel(context.Background())
+
+	c.mu.Lock()
+
+	now := time.Now().UnixNano()
+	clone.nextGen = c.nextGen
+
+	for _, m := range []recordMap{c.reachable, c.unreachable} {
+		for index, rec := range m {
+			if rec.isExpired(now) {
+				continue
+			}
+			cp := *rec
+			cp.refs, cp.refSince, cp.leaked = 0, 0, false
+			// The contexts invalidate only the records of c.
+			cp.scopes = nil
+			clone.addUnreachable(index, &cp, now)
+			clone.bytes += rec.size
+			clone.stats.weight.Add(rec.weight)
+		}
+	}
+
+	c.mu.Unlock()
+
+	clone.storeCounts()
+	clone.SetGCInterval(gcInterval)
+
+	return clone
+}
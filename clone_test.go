@@ -0,0 +1,49 @@
+package weakcache_test
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mgnsk/weakcache"
+	. "github.com/onsi/gomega"
+)
+
+func TestClone(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	var recs []*weakcache.Record
+	for _, key := range []string{"a", "b"} {
+		key := key
+		rec, err := cache.Fetch(key, time.Minute, 0, func() (interface{}, error) {
+			return key, nil
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		recs = append(recs, rec)
+	}
+
+	clone := cache.Clone()
+	defer clone.Close()
+
+	// The records start unreferenced in the clone.
+	reachable, unreachable := clone.Counts()
+	g.Expect(reachable).To(Equal(0))
+	g.Expect(unreachable).To(Equal(2))
+
+	rec := clone.Store("c", "c", time.Minute, 0)
+	clone.InvalidatePrefix("a")
+
+	g.Expect(clone.Contains("a")).To(BeFalse())
+	g.Expect(clone.Contains("b")).To(BeTrue())
+	g.Expect(clone.Contains("c")).To(BeTrue())
+
+	g.Expect(cache.Contains("a")).To(BeTrue())
+	g.Expect(cache.Contains("b")).To(BeTrue())
+	g.Expect(cache.Contains("c")).To(BeFalse())
+
+	runtime.KeepAlive(recs)
+	runtime.KeepAlive(rec)
+}
@@ -0,0 +1,51 @@
+package weakcache
+
+import (
+	"errors"
+	"sort"
+)
+
+// Drain removes all records from the cache, including expired and
+// referenced ones, and calls fn for each of them in key order.
+// It returns the errors returned by fn joined with errors.Join.
+//
+// Unlike eviction, draining does not run the eviction callback, close
+// the values or send eviction events, so that fn can persist or release
+// the values. fn is called without holding the cache mutex. Drain may be
+// called after Close to flush the records left in the cache on shutdown,
+// though with WithAutoClose their values have been closed by Close.
+func (c *Cache) Drain(fn func(key string, value interface{}) error) error {
+	c.mu.Lock()
+	drained := make([]*Record, 0, len(c.reachable)+len(c.unreachable))
+	for _, m := range []recordMap{c.reachable, c.unreachable} {
+		for index, rec := range m {
+			// Pointers to the record keep its value. Their
+			// unrefs are ignored due to the generation.
+			delete(m, index)
+			for _, stop := range rec.scopes {
+				stop()
+			}
+			rec.scopes = nil
+			c.bytes -= rec.size
+			c.stats.weight.Add(-rec.weight)
+			drained = append(drained, rec)
+		}
+	}
+	c.unreachableBytes = 0
+	c.sweepQueue = nil
+	c.sweepQueued = 0
+	c.unlock()
+
+	sort.Slice(drained, func(i, j int) bool {
+		return drained[i].key < drained[j].key
+	})
+
+	var errs []error
+	for _, rec := range drained {
+		if err := fn(rec.key, rec.Value); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,67 @@
+package weakcache_test
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mgnsk/weakcache"
+	. "github.com/onsi/gomega"
+)
+
+func TestDrain(t *testing.T) {
+	g := NewWithT(t)
+
+	evicted := &evictedKeys{}
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSyncEviction(),
+		weakcache.WithEvictionCallback(evicted.add),
+	)
+	defer cache.Close()
+
+	// "a" is referenced and "b" and "c" are not.
+	rec := cache.Store("a", "a", time.Minute, 0)
+	cache.Preload(map[string]interface{}{"b": "b", "c": "c"}, time.Minute, 0)
+
+	errB := errors.New("b failed")
+	errC := errors.New("c failed")
+
+	var visited []string
+	err := cache.Drain(func(key string, value interface{}) error {
+		g.Expect(value).To(Equal(key))
+		visited = append(visited, key)
+		switch key {
+		case "b":
+			return errB
+		case "c":
+			return errC
+		default:
+			return nil
+		}
+	})
+
+	g.Expect(visited).To(Equal([]string{"a", "b", "c"}))
+	g.Expect(errors.Is(err, errB)).To(BeTrue())
+	g.Expect(errors.Is(err, errC)).To(BeTrue())
+
+	g.Expect(cache.Len()).To(Equal(0))
+	g.Expect(cache.Verify()).To(Succeed())
+	g.Expect(evicted.get()).To(BeEmpty())
+
+	// The unref of the drained record is ignored.
+	runtime.KeepAlive(rec)
+	rec = nil
+	runtime.GC()
+	cache.Sync()
+
+	g.Expect(cache.Len()).To(Equal(0))
+	g.Expect(cache.Verify()).To(Succeed())
+
+	g.Expect(cache.Drain(func(string, interface{}) error {
+		t.Fatal("drained an empty cache")
+		return nil
+	})).To(Succeed())
+}
@@ -0,0 +1,159 @@
+package weakcache
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// eventBufferSize is the capacity of the eviction event channel.
+const eventBufferSize = 1024
+
+// EvictionReason is the reason a record was evicted.
+type EvictionReason int
+
+const (
+	// EvictionExpired means the record expired.
+	EvictionExpired EvictionReason = iota
+	// EvictionReplaced means the record was replaced by a new record.
+	EvictionReplaced
+	// EvictionInvalidated means the record was invalidated.
+	EvictionInvalidated
+	// EvictionCapacity means the record was evicted to stay within the size limit.
+	EvictionCapacity
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionExpired:
+		return "expired"
+	case EvictionReplaced:
+		return "replaced"
+	case EvictionInvalidated:
+		return "invalidated"
+	case EvictionCapacity:
+		return "capacity"
+	default:
+		return "unknown"
+	}
+}
+
+// EvictionEvent describes an evicted record.
+type EvictionEvent struct {
+	Key    string
+	Reason EvictionReason
+	Time   time.Time
+}
+
+// eviction is an evicted record waiting to be notified about.
+type eviction struct {
+	rec    *Record
+	reason EvictionReason
+	time   int64
+	// replacement is the value of the record of the same key
+	// which replaced rec.
+	replacement interface{}
+}
+
+// Events returns a channel which receives an event for each eviction.
+// Events are dropped if the channel buffer is full. The channel is
+// closed when the cache is closed.
+func (c *Cache) Events() <-chan EvictionEvent {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+
+	if c.events == nil {
+		c.events = make(chan EvictionEvent, eventBufferSize)
+		if c.eventsClosed {
+			close(c.events)
+		}
+	}
+
+	return c.events
+}
+
+// sendEvent sends an eviction event without blocking.
+func (c *Cache) sendEvent(ev eviction) {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+
+	if c.events == nil || c.eventsClosed {
+		return
+	}
+
+	select {
+	case c.events <- EvictionEvent{
+		Key:    ev.rec.key,
+		Reason: ev.reason,
+		Time:   time.Unix(0, ev.time),
+	}:
+	default:
+		c.stats.droppedEvents.Add(1)
+		c.log(slog.LevelWarn, "weakcache: eviction event dropped", "key", ev.rec.key, "reason", ev.reason.String())
+	}
+}
+
+// closeEvents closes the eviction event channel.
+func (c *Cache) closeEvents() {
+	c.eventsMu.Lock()
+	defer c.eventsMu.Unlock()
+
+	c.eventsClosed = true
+	if c.events != nil {
+		close(c.events)
+	}
+}
+
+// queueEvictions queues evicted records to be dispatched by the eviction
+// worker, so that a slow eviction callback does not block the caller.
+func (c *Cache) queueEvictions(evicted []eviction) {
+	c.evictMu.Lock()
+	defer c.evictMu.Unlock()
+
+	c.evictQueue = append(c.evictQueue, evicted...)
+
+	if !c.evictBusy {
+		c.evictBusy = true
+		go c.evictWorker()
+	}
+}
+
+// evictWorker dispatches queued evictions until the queue is empty.
+func (c *Cache) evictWorker() {
+	for {
+		c.evictMu.Lock()
+		evicted := c.evictQueue
+		c.evictQueue = nil
+		if len(evicted) == 0 {
+			c.evictBusy = false
+			for _, ch := range c.evictIdle {
+				close(ch)
+			}
+			c.evictIdle = nil
+			c.evictMu.Unlock()
+			return
+		}
+		c.evictMu.Unlock()
+
+		c.dispatchEvictions(evicted)
+	}
+}
+
+// waitEvictions waits until all queued evictions have been dispatched.
+func (c *Cache) waitEvictions(ctx context.Context) error {
+	c.evictMu.Lock()
+	if !c.evictBusy {
+		c.evictMu.Unlock()
+		return nil
+	}
+	idle := make(chan struct{})
+	c.evictIdle = append(c.evictIdle, idle)
+	c.evictMu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,97 @@
+package weakcache_test
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mgnsk/weakcache"
+	. "github.com/onsi/gomega"
+)
+
+func TestEvents(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+
+	events := cache.Events()
+
+	fetch := func(key string) *weakcache.Record {
+		rec, err := cache.Fetch(key, 0, 0, func() (interface{}, error) {
+			return "value", nil
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		return rec
+	}
+
+	start := time.Now()
+
+	rec1 := fetch("replaced")
+	rec2 := cache.Store("replaced", "new value", 0, 0)
+
+	rec3 := fetch("invalidated")
+	g.Expect(cache.InvalidatePrefix("invalidated")).To(Equal(1))
+
+	fetch("expired")
+
+	runtime.GC()
+
+	var received []weakcache.EvictionEvent
+	for len(received) < 3 {
+		var ev weakcache.EvictionEvent
+		g.Eventually(events).Should(Receive(&ev))
+		received = append(received, ev)
+	}
+
+	for _, ev := range received {
+		g.Expect(ev.Time).To(BeTemporally(">=", start))
+		g.Expect(ev.Time).To(BeTemporally("<=", time.Now()))
+	}
+
+	g.Expect(received[0].Key).To(Equal("replaced"))
+	g.Expect(received[0].Reason).To(Equal(weakcache.EvictionReplaced))
+	g.Expect(received[1].Key).To(Equal("invalidated"))
+	g.Expect(received[1].Reason).To(Equal(weakcache.EvictionInvalidated))
+	g.Expect(received[2].Key).To(Equal("expired"))
+	g.Expect(received[2].Reason).To(Equal(weakcache.EvictionExpired))
+
+	cache.Close()
+
+	// The channel is closed with the cache.
+	g.Eventually(events).Should(BeClosed())
+
+	runtime.KeepAlive(rec1)
+	runtime.KeepAlive(rec2)
+	runtime.KeepAlive(rec3)
+}
+
+func TestEventsDropped(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSyncEviction(),
+	)
+	defer cache.Close()
+
+	events := cache.Events()
+
+	const n = 2000
+
+	var recs []*weakcache.Record
+	for i := 0; i < n; i++ {
+		rec, _ := cache.Fetch(fmt.Sprintf("key%d", i), 0, 0, func() (interface{}, error) {
+			return "value", nil
+		})
+		recs = append(recs, rec)
+	}
+
+	// Evict without consuming the events.
+	g.Expect(cache.InvalidatePrefix("key")).To(Equal(n))
+
+	g.Expect(len(events)).To(Equal(cap(events)))
+	g.Expect(cache.Stats().DroppedEvents).To(Equal(uint64(n - cap(events))))
+
+	runtime.KeepAlive(recs)
+}
@@ -0,0 +1,29 @@
+// Package expvarcache publishes weakcache statistics with the expvar package.
+//
+// It is a separate package because importing expvar registers
+// the /debug/vars handler on http.DefaultServeMux.
+package expvarcache
+
+import (
+	"expvar"
+
+	"github.com/mgnsk/weakcache"
+)
+
+// Publish publishes the statistics of c as an expvar.Func with the given name.
+// Like expvar.Publish, it panics if the name is already registered.
+func Publish(name string, c *weakcache.Cache) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		reachable, unreachable := c.Counts()
+		stats := c.Stats()
+
+		return map[string]interface{}{
+			"len":         reachable + unreachable,
+			"reachable":   reachable,
+			"unreachable": unreachable,
+			"hits":        stats.Hits,
+			"misses":      stats.Misses,
+			"evictions":   stats.Evictions,
+		}
+	}))
+}
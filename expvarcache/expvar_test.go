@@ -0,0 +1,52 @@
+package expvarcache_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mgnsk/weakcache"
+	"github.com/mgnsk/weakcache/expvarcache"
+	. "github.com/onsi/gomega"
+)
+
+func TestPublish(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	for i := 0; i < 2; i++ {
+		rec, _ := cache.Fetch("key", time.Minute, 0, func() (interface{}, error) {
+			return "value", nil
+		})
+		g.Expect(rec.Value).To(Equal("value"))
+		runtime.KeepAlive(rec)
+	}
+
+	// Use a unique name since expvar names can't be unregistered.
+	name := fmt.Sprintf("weakcache_%d", time.Now().UnixNano())
+	expvarcache.Publish(name, cache)
+
+	v := expvar.Get(name)
+	g.Expect(v).NotTo(BeNil())
+
+	var stats struct {
+		Len         int    `json:"len"`
+		Reachable   int    `json:"reachable"`
+		Unreachable int    `json:"unreachable"`
+		Hits        uint64 `json:"hits"`
+		Misses      uint64 `json:"misses"`
+		Evictions   uint64 `json:"evictions"`
+	}
+	g.Expect(json.Unmarshal([]byte(v.String()), &stats)).To(Succeed())
+
+	g.Expect(stats.Len).To(Equal(1))
+	g.Expect(stats.Reachable + stats.Unreachable).To(Equal(1))
+	g.Expect(stats.Hits).To(Equal(uint64(1)))
+	g.Expect(stats.Misses).To(Equal(uint64(1)))
+	g.Expect(stats.Evictions).To(Equal(uint64(0)))
+}
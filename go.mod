@@ -1,5 +1,12 @@
 module github.com/mgnsk/weakcache
 
-go 1.14
+go 1.21
 
 require github.com/onsi/gomega v1.9.0
+
+require (
+	golang.org/x/net v0.0.0-20180906233101-161cd47e91fd // indirect
+	golang.org/x/text v0.3.0 // indirect
+	golang.org/x/xerrors v0.0.0-20190717185122-a985d3407aa7 // indirect
+	gopkg.in/yaml.v2 v2.2.4 // indirect
+)
@@ -0,0 +1,48 @@
+package weakcache
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/maphash"
+	"time"
+	"unsafe"
+)
+
+// FetchBytes is like Fetch with a []byte key. A cache hit does not
+// allocate a string for the key. The key is equivalent to string(key),
+// so FetchBytes and Fetch share records of equal keys.
+//
+// The key is not retained and may be modified after FetchBytes returns.
+func (c *Cache) FetchBytes(key []byte, minTTL, maxTTL time.Duration, fetch fetch) (*Record, error) {
+	index := c.indexBytes(key)
+
+	// The temporary string is only used for comparing keys.
+	if rec, ok := c.load(unsafe.String(unsafe.SliceData(key), len(key)), index); ok {
+		return rec, nil
+	}
+
+	return c.acquire(context.Background(), string(key), index, 0, minTTL, maxTTL, func() (interface{}, time.Duration, error) {
+		value, err := fetch()
+		return value, 0, err
+	})
+}
+
+// FetchUint64 is like Fetch with an integer key. The key is equivalent
+// to the 8 bytes of key in little-endian order passed to FetchBytes.
+func (c *Cache) FetchUint64(key uint64, minTTL, maxTTL time.Duration, fetch fetch) (*Record, error) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], key)
+	return c.FetchBytes(b[:], minTTL, maxTTL, fetch)
+}
+
+// indexBytes returns the same index as c.index(string(key)).
+// A custom hash function requires converting the key to a string.
+func (c *Cache) indexBytes(key []byte) uint64 {
+	if c.hash != nil {
+		return c.hash(string(key))
+	}
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	h.Write(key)
+	return h.Sum64()
+}
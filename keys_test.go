@@ -0,0 +1,110 @@
+package weakcache_test
+
+import (
+	"encoding/binary"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mgnsk/weakcache"
+	. "github.com/onsi/gomega"
+)
+
+func TestFetchBytes(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	rec1, err := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	buf := []byte("key")
+	rec2, err := cache.FetchBytes(buf, 0, 0, func() (interface{}, error) {
+		panic("unexpected fetch fallback")
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec2.Value).To(Equal("value"))
+
+	// The key buffer is not retained.
+	copy(buf, "new")
+	rec3, err := cache.FetchBytes(buf, 0, 0, func() (interface{}, error) {
+		return "new value", nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec3.Value).To(Equal("new value"))
+
+	copy(buf, "xyz")
+	g.Expect(cache.Contains("key")).To(BeTrue())
+	g.Expect(cache.Contains("new")).To(BeTrue())
+	g.Expect(cache.Len()).To(Equal(2))
+
+	runtime.KeepAlive(rec1)
+	runtime.KeepAlive(rec2)
+	runtime.KeepAlive(rec3)
+}
+
+func TestFetchUint64(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	rec1, err := cache.FetchUint64(42, 0, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	var key [8]byte
+	binary.LittleEndian.PutUint64(key[:], 42)
+
+	rec2, err := cache.Fetch(string(key[:]), 0, 0, func() (interface{}, error) {
+		panic("unexpected fetch fallback")
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec2.Value).To(Equal("value"))
+
+	runtime.KeepAlive(rec1)
+	runtime.KeepAlive(rec2)
+}
+
+func BenchmarkFetchBytes(b *testing.B) {
+	key := []byte("a key which is longer than the small string buffer")
+	fetch := func() (interface{}, error) {
+		return "value", nil
+	}
+
+	b.Run("string", func(b *testing.B) {
+		cache := weakcache.New()
+		defer cache.Close()
+
+		rec, _ := cache.Fetch(string(key), time.Hour, 0, fetch)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			_, _ = cache.Fetch(string(key), time.Hour, 0, fetch)
+		}
+
+		runtime.KeepAlive(rec)
+	})
+
+	b.Run("bytes", func(b *testing.B) {
+		cache := weakcache.New()
+		defer cache.Close()
+
+		rec, _ := cache.FetchBytes(key, time.Hour, 0, fetch)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			_, _ = cache.FetchBytes(key, time.Hour, 0, fetch)
+		}
+
+		runtime.KeepAlive(rec)
+	})
+}
@@ -0,0 +1,325 @@
+package weakcache
+
+import (
+	"hash/maphash"
+	"log/slog"
+	"time"
+)
+
+// defaultGCInterval is the interval of the GC loop
+// when the cache is created without WithGCInterval.
+const defaultGCInterval = time.Second
+
+// Option configures a Cache.
+type Option func(*Cache)
+
+// WithGCInterval sets the interval at which the GC loop
+// cleans up expired unreachable records.
+//
+// A zero or negative interval disables the GC loop. Expired records
+// are then only evicted when they are fetched again.
+func WithGCInterval(d time.Duration) Option {
+	return func(c *Cache) {
+		c.gcInterval = d
+	}
+}
+
+// WithDefaultTTL sets the TTLs used by FetchDefault.
+func WithDefaultTTL(minTTL, maxTTL time.Duration) Option {
+	return func(c *Cache) {
+		c.defaultMinTTL = minTTL
+		c.defaultMaxTTL = maxTTL
+	}
+}
+
+// WithSweepLimit sets the maximum number of unreachable records
+// inspected by a single GC tick. It bounds the time the cache
+// is locked by the GC loop. Zero means no limit.
+func WithSweepLimit(n int) Option {
+	return func(c *Cache) {
+		c.sweepLimit = n
+	}
+}
+
+// WithAdaptiveSweep makes each GC tick inspect as many unreachable records
+// as became unreachable since the previous tick, plus a part of the records
+// left from the previous ticks, within the limit set by WithSweepLimit.
+// The sweeps then keep up with bursts without scanning the whole backlog.
+func WithAdaptiveSweep() Option {
+	return func(c *Cache) {
+		c.adaptiveSweep = true
+	}
+}
+
+// WithInitialCapacity sets the initial capacity of the record maps,
+// avoiding their growth while a cache of a known size is filled.
+func WithInitialCapacity(n int) Option {
+	return func(c *Cache) {
+		if n > 0 {
+			c.capacity = n
+		}
+	}
+}
+
+// WithServeStaleOnError makes a fetch return the record past its maxTTL
+// instead of the error of the fallback, for up to maxStale after the
+// record expired. Record.Stale reports whether a record is stale.
+// Stale records are kept until maxStale has passed unless they are
+// unreferenced for their minTTL.
+func WithServeStaleOnError(maxStale time.Duration) Option {
+	return func(c *Cache) {
+		c.maxStale = maxStale
+	}
+}
+
+// WithEvictionCallback sets a callback which is called with the key
+// and value of each evicted record. It runs without the cache locked,
+// on a worker goroutine unless WithSyncEviction is set. A panic in
+// the callback is recovered.
+func WithEvictionCallback(fn func(key string, value interface{})) Option {
+	return func(c *Cache) {
+		c.onEvict = fn
+	}
+}
+
+// WithReplaceCallback sets a callback which is called like the eviction
+// callback, also with the value which replaced the evicted value of key.
+// newValue is nil unless the record was replaced by a record of the same key,
+// such as by Store or by a fetch of an expired record.
+func WithReplaceCallback(fn func(key string, oldValue, newValue interface{})) Option {
+	return func(c *Cache) {
+		c.onReplace = fn
+	}
+}
+
+// WithEvictionFilter sets a filter which is called with the key and value
+// of each expired record before it is evicted by a sweep or a fetch. Returning
+// false keeps the record, and a record not referenced for its minTTL is granted
+// another minTTL. A fetch still replaces a kept record past its maxTTL.
+// The filter runs with the cache locked and must not call the cache.
+// Use it sparingly since kept records are not freed.
+func WithEvictionFilter(fn func(key string, value interface{}) bool) Option {
+	return func(c *Cache) {
+		c.evictFilter = fn
+	}
+}
+
+// WithValidator sets a function which checks the value of each cached
+// record found by a fetch. A record whose value is not valid is evicted
+// and fetched again, as if it was not cached. The validator runs with
+// the cache locked, so it must be fast and must not call the cache.
+func WithValidator(fn func(value interface{}) bool) Option {
+	return func(c *Cache) {
+		c.validate = fn
+	}
+}
+
+// WithHashFunc sets the function used to hash keys. By default,
+// keys are hashed with hash/maphash using a random seed.
+// Records of colliding keys replace each other.
+func WithHashFunc(fn func(key string) uint64) Option {
+	return func(c *Cache) {
+		c.hash = fn
+	}
+}
+
+// WithSeed sets the hash/maphash seed used to hash keys instead of
+// a random seed, so that caches with the same seed map keys to
+// the same indexes. It has no effect with WithHashFunc.
+func WithSeed(seed maphash.Seed) Option {
+	return func(c *Cache) {
+		c.seed = seed
+	}
+}
+
+// WithMaxConcurrentFetches limits the number of fetch fallbacks running
+// at the same time to n. When the limit is reached, Fetch waits for
+// a fallback to complete or, if failFast is set, returns ErrTooManyFetches.
+// Cache hits are not limited. A zero or negative n means no limit.
+func WithMaxConcurrentFetches(n int, failFast bool) Option {
+	return func(c *Cache) {
+		c.fetchSem = nil
+		if n > 0 {
+			c.fetchSem = make(chan struct{}, n)
+		}
+		c.failFast = failFast
+	}
+}
+
+// WithAutoClose enables closing evicted values which implement io.Closer.
+// Values are closed after the eviction callback, even if pointers
+// to their records are still alive. The values left in the cache
+// are closed by Close, and values returned by fallbacks which complete
+// after Close are closed instead of cached.
+func WithAutoClose(enabled bool) Option {
+	return func(c *Cache) {
+		c.autoClose = enabled
+	}
+}
+
+// WithSoftMaxTTL makes maxTTL a soft limit for referenced records.
+// A referenced record whose maxTTL has passed is still returned by Fetch,
+// so that all live pointers of a key share the same value. The value is
+// fetched again only after all references are gone and the record expires.
+//
+// The tradeoff is that a frequently referenced record may be served
+// long after its maxTTL, until there is a moment with no references.
+func WithSoftMaxTTL(enabled bool) Option {
+	return func(c *Cache) {
+		c.softMaxTTL = enabled
+	}
+}
+
+// WithCacheNil sets whether a nil value returned by the fallback is cached,
+// which is the default. When disabled, the nil value is returned to the
+// callers without being cached, so the next Fetch calls the fallback again.
+// Only an untyped nil interface value is considered nil. For example,
+// a nil *T returned as interface{} is cached.
+func WithCacheNil(enabled bool) Option {
+	return func(c *Cache) {
+		c.cacheNil = enabled
+	}
+}
+
+// WithRefcountChecks enables panicking on reference count underflow and
+// overflow instead of wrapping around, which would leak the record.
+// It is intended for debugging.
+func WithRefcountChecks(enabled bool) Option {
+	return func(c *Cache) {
+		c.refcountChecks = enabled
+	}
+}
+
+// WithErrorHandler sets a function which is called with errors
+// that can't be returned to a caller, such as errors from closing
+// evicted values.
+func WithErrorHandler(fn func(err error)) Option {
+	return func(c *Cache) {
+		c.onError = fn
+	}
+}
+
+// WithKeyStats enables counting hits and misses per key for TopKeys.
+// The stats of every fetched key are kept until the cache is
+// garbage collected, so memory use grows with the number of keys.
+func WithKeyStats(enabled bool) Option {
+	return func(c *Cache) {
+		if enabled {
+			c.stats.keys = make(map[string]*KeyStat)
+		} else {
+			c.stats.keys = nil
+		}
+	}
+}
+
+// WithSyncEviction makes the eviction callback run in the goroutine
+// which evicted the records, in eviction order, after the cache is unlocked.
+// By default, the eviction callbacks run in order on a worker goroutine
+// so that a slow callback does not stall the GC loop or the caller.
+func WithSyncEviction() Option {
+	return func(c *Cache) {
+		c.syncEviction = true
+	}
+}
+
+// WithSlidingGrace makes each fetch hit of a record restart its minTTL
+// grace period. By default, a record revived from the unreachable state
+// keeps the grace period which started when it was last unreferenced,
+// so it expires after minTTL even if it is referenced again.
+func WithSlidingGrace() Option {
+	return func(c *Cache) {
+		c.slidingGrace = true
+	}
+}
+
+// WithSlidingMaxTTL makes each fetch hit of a record extend its expiry
+// to maxTTL from the hit, so that records which are fetched often do not
+// expire. An unreachable record revived by a hit is extended as well,
+// but it still expires after minTTL once it is unreferenced again.
+// The hits then read the clock while the cache is locked.
+func WithSlidingMaxTTL() Option {
+	return func(c *Cache) {
+		c.slidingMaxTTL = true
+	}
+}
+
+// WithLeakDetection makes the GC loop count the records which stay
+// referenced for longer than threshold in Stats.SuspectedLeaks and log
+// their keys at warning level. It inspects every referenced record
+// on each GC tick, so it is meant for diagnostics.
+func WithLeakDetection(threshold time.Duration) Option {
+	return func(c *Cache) {
+		c.leakThreshold = threshold
+	}
+}
+
+// WithLogger sets a logger for diagnostic events, such as recovered
+// eviction callback panics, errors from closing evicted values,
+// dropped eviction events and fetches after Close.
+// By default, nothing is logged.
+func WithLogger(l *slog.Logger) Option {
+	return func(c *Cache) {
+		c.logger = l
+	}
+}
+
+// WithFetchTimeout sets how long Fetch waits for the fallback.
+// On timeout, Fetch returns ErrFetchTimeout. The fallback keeps running
+// in the background and its result is stored only if other callers
+// are still waiting for it.
+func WithFetchTimeout(d time.Duration) Option {
+	return func(c *Cache) {
+		c.fetchTimeout = d
+	}
+}
+
+// WithFetchDeadline makes FetchContext cancel the context of the fallback
+// after fraction of maxTTL has passed, so that a fallback does not run for
+// longer than its value would be valid. A zero maxTTL sets no deadline.
+func WithFetchDeadline(fraction float64) Option {
+	return func(c *Cache) {
+		c.fetchDeadline = fraction
+	}
+}
+
+// WithFetchRetry makes Fetch call a failing fallback up to attempts times
+// in total before returning the last error. backoff returns how long to
+// wait after the given failed attempt, starting from 1. A nil backoff
+// retries immediately. The cache is not locked during the backoff. Retries
+// stop when all waiting callers have given up, when the cache is closed or
+// when the fetch timeout has passed since the first attempt.
+func WithFetchRetry(attempts int, backoff func(attempt int) time.Duration) Option {
+	return func(c *Cache) {
+		c.fetchAttempts = attempts
+		c.fetchBackoff = backoff
+	}
+}
+
+// WithFetchLatency sets whether the durations of the fetch fallbacks
+// are recorded in Stats, which is the default.
+func WithFetchLatency(enabled bool) Option {
+	return func(c *Cache) {
+		c.fetchLatency = enabled
+	}
+}
+
+// WithMaxBytes limits the total size of the cached values which implement Sizer.
+// When the limit is exceeded, unreferenced records are evicted, lowest weight
+// first and then in the order set by WithEvictionPolicy. Referenced records
+// and values which do not implement Sizer are never evicted for size. While
+// the referenced records alone exceed the limit, nothing is evicted.
+func WithMaxBytes(n int64) Option {
+	return func(c *Cache) {
+		c.maxBytes = n
+	}
+}
+
+// WithEvictionPolicy sets the policy by which unreferenced records are
+// evicted when the limit set by WithMaxBytes is exceeded. The default is LRU.
+// With LFU, each record counts its accesses and the count halves every minute,
+// so that records which were popular only in the past are evicted eventually.
+func WithEvictionPolicy(p EvictionPolicy) Option {
+	return func(c *Cache) {
+		c.policy = p
+	}
+}
@@ -0,0 +1,1522 @@
+package weakcache_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mgnsk/weakcache"
+	. "github.com/onsi/gomega"
+)
+
+func TestDefaultOptions(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New()
+	defer cache.Close()
+
+	rec, err := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.Value).To(Equal("value"))
+	g.Expect(cache.Len()).To(Equal(1))
+}
+
+func TestCombinedOptions(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSweepLimit(1),
+	)
+	defer cache.Close()
+
+	for i := 0; i < 3; i++ {
+		rec, _ := cache.Fetch(fmt.Sprintf("key%d", i), 0, 0, func() (interface{}, error) {
+			return "value", nil
+		})
+		g.Expect(rec.Value).To(Equal("value"))
+	}
+
+	g.Expect(cache.Len()).To(Equal(3))
+
+	runtime.GC()
+
+	// One record is swept per GC tick.
+	g.Eventually(func() int {
+		return cache.Len()
+	}).Should(Equal(0))
+}
+
+func TestZeroGCInterval(t *testing.T) {
+	g := NewWithT(t)
+
+	before := runtime.NumGoroutine()
+
+	cache := weakcache.New(weakcache.WithGCInterval(0))
+
+	rec1, _ := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+
+	g.Expect(rec1.Value).To(Equal("value"))
+
+	runtime.KeepAlive(rec1)
+
+	runtime.GC()
+
+	// No background goroutine was started. Goroutines of previously
+	// closed caches may still be exiting.
+	g.Eventually(func() int {
+		return runtime.NumGoroutine()
+	}).Should(BeNumerically("<=", before))
+
+	// The unreachable record is not swept without the GC loop.
+	g.Consistently(func() int {
+		return cache.Len()
+	}, 50*time.Millisecond).Should(Equal(1))
+
+	// It is evicted during fetch instead.
+	time.Sleep(time.Millisecond)
+	rec2, _ := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+		return "new value", nil
+	})
+
+	g.Expect(rec2.Value).To(Equal("new value"))
+
+	cache.Close()
+
+	// The eviction worker exits after dispatching the eviction.
+	g.Eventually(func() int {
+		return runtime.NumGoroutine()
+	}).Should(BeNumerically("<=", before))
+}
+
+func TestHashFunc(t *testing.T) {
+	g := NewWithT(t)
+
+	evicted := &evictedKeys{}
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSyncEviction(),
+		weakcache.WithHashFunc(func(string) uint64 {
+			return 1
+		}),
+		weakcache.WithEvictionCallback(evicted.add),
+	)
+	defer cache.Close()
+
+	fetch := func(key string) (*weakcache.Record, int) {
+		calls := 0
+		rec, err := cache.Fetch(key, time.Minute, 0, func() (interface{}, error) {
+			calls++
+			return key, nil
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		return rec, calls
+	}
+
+	recA, calls := fetch("a")
+	g.Expect(recA.Value).To(Equal("a"))
+	g.Expect(calls).To(Equal(1))
+
+	// All keys collide. Fetching another key replaces the record.
+	recB, calls := fetch("b")
+	g.Expect(recB.Value).To(Equal("b"))
+	g.Expect(calls).To(Equal(1))
+
+	g.Expect(cache.Len()).To(Equal(1))
+	g.Expect(cache.Contains("a")).To(BeFalse())
+	g.Expect(cache.Contains("b")).To(BeTrue())
+	g.Expect(evicted.get()).To(Equal([]string{"a"}))
+
+	rec, calls := fetch("b")
+	g.Expect(rec.Value).To(Equal("b"))
+	g.Expect(calls).To(Equal(0))
+
+	rec, calls = fetch("a")
+	g.Expect(rec.Value).To(Equal("a"))
+	g.Expect(calls).To(Equal(1))
+
+	g.Expect(evicted.get()).To(Equal([]string{"a", "b"}))
+
+	// Pointers to replaced records keep their values.
+	g.Expect(recA.Value).To(Equal("a"))
+	g.Expect(recB.Value).To(Equal("b"))
+}
+
+func TestMaxConcurrentFetches(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithMaxConcurrentFetches(2, false),
+	)
+	defer cache.Close()
+
+	hit, _ := cache.Fetch("hit", 0, 0, func() (interface{}, error) {
+		return "value", nil
+	})
+
+	var running, maxRunning int32
+	release := make(chan struct{})
+
+	var results []<-chan weakcache.FetchResult
+	for i := 0; i < 10; i++ {
+		results = append(results, cache.FetchAsync(fmt.Sprintf("key%d", i), 0, 0, func() (interface{}, error) {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			<-release
+			return "value", nil
+		}))
+	}
+
+	g.Eventually(func() int32 {
+		return atomic.LoadInt32(&running)
+	}).Should(Equal(int32(2)))
+
+	// Cache hits are not blocked by the saturated fallbacks.
+	rec, err := cache.Fetch("hit", 0, 0, func() (interface{}, error) {
+		panic("unexpected fetch fallback")
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.Value).To(Equal("value"))
+
+	close(release)
+
+	for _, ch := range results {
+		res := <-ch
+		g.Expect(res.Err).NotTo(HaveOccurred())
+	}
+
+	g.Expect(atomic.LoadInt32(&maxRunning)).To(Equal(int32(2)))
+
+	runtime.KeepAlive(hit)
+}
+
+func TestMaxConcurrentFetchesFailFast(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithMaxConcurrentFetches(1, true),
+	)
+	defer cache.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	result := cache.FetchAsync("key1", 0, 0, func() (interface{}, error) {
+		close(started)
+		<-release
+		return "value", nil
+	})
+
+	<-started
+
+	_, err := cache.Fetch("key2", 0, 0, func() (interface{}, error) {
+		panic("unexpected fetch fallback")
+	})
+	g.Expect(err).To(MatchError(weakcache.ErrTooManyFetches))
+
+	close(release)
+
+	res := <-result
+	g.Expect(res.Err).NotTo(HaveOccurred())
+	g.Expect(res.Record.Value).To(Equal("value"))
+}
+
+func TestMaxConcurrentFetchesNoLimit(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		g := NewWithT(t)
+
+		cache := weakcache.New(weakcache.WithMaxConcurrentFetches(n, false))
+
+		rec, err := cache.Fetch("key", time.Minute, 0, func() (interface{}, error) {
+			return "value", nil
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(rec.Value).To(Equal("value"))
+
+		cache.Close()
+	}
+}
+
+type fakeCloser struct {
+	closed int32
+	err    error
+	delay  time.Duration
+}
+
+func (c *fakeCloser) Close() error {
+	time.Sleep(c.delay)
+	atomic.AddInt32(&c.closed, 1)
+	return c.err
+}
+
+func TestAutoClose(t *testing.T) {
+	g := NewWithT(t)
+
+	errClose := errors.New("close failed")
+
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSyncEviction(),
+		weakcache.WithAutoClose(true),
+		weakcache.WithErrorHandler(func(err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		}),
+	)
+	defer cache.Close()
+
+	fetch := func(key string, maxTTL time.Duration, v interface{}) *weakcache.Record {
+		rec, err := cache.Fetch(key, 0, maxTTL, func() (interface{}, error) {
+			return v, nil
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		return rec
+	}
+
+	swept := &fakeCloser{}
+	replaced := &fakeCloser{}
+	invalidated := &fakeCloser{err: errClose}
+	expired := &fakeCloser{}
+	kept := &fakeCloser{}
+
+	// Evicted by the GC loop.
+	fetch("swept", 0, swept)
+
+	runtime.GC()
+
+	g.Eventually(func() int32 {
+		return atomic.LoadInt32(&swept.closed)
+	}).Should(Equal(int32(1)))
+
+	// Evicted by Store.
+	rec1 := fetch("replaced", 0, replaced)
+	rec2 := cache.Store("replaced", "value", 0, 0)
+
+	g.Expect(atomic.LoadInt32(&replaced.closed)).To(Equal(int32(1)))
+
+	// Evicted by InvalidatePrefix.
+	rec3 := fetch("invalidated", 0, invalidated)
+	g.Expect(cache.InvalidatePrefix("invalidated")).To(Equal(1))
+
+	g.Expect(atomic.LoadInt32(&invalidated.closed)).To(Equal(int32(1)))
+
+	// Evicted during fetch.
+	rec4 := fetch("expired", time.Millisecond, expired)
+	time.Sleep(2 * time.Millisecond)
+	rec5 := fetch("expired", 0, "value")
+
+	g.Expect(atomic.LoadInt32(&expired.closed)).To(Equal(int32(1)))
+
+	rec6 := fetch("kept", 0, kept)
+
+	// Each value was closed exactly once.
+	g.Consistently(func() []int32 {
+		return []int32{
+			atomic.LoadInt32(&swept.closed),
+			atomic.LoadInt32(&replaced.closed),
+			atomic.LoadInt32(&invalidated.closed),
+			atomic.LoadInt32(&expired.closed),
+			atomic.LoadInt32(&kept.closed),
+		}
+	}, 50*time.Millisecond).Should(Equal([]int32{1, 1, 1, 1, 0}))
+
+	mu.Lock()
+	g.Expect(errs).To(HaveLen(1))
+	g.Expect(errs[0]).To(MatchError(errClose))
+	mu.Unlock()
+
+	// Closed by Close, whether referenced or not.
+	unreferenced := &fakeCloser{}
+	cache.Preload(map[string]interface{}{"unreferenced": unreferenced}, time.Minute, 0)
+
+	cache.Close()
+	cache.Close()
+	cache.Sync()
+
+	g.Expect(atomic.LoadInt32(&kept.closed)).To(Equal(int32(1)))
+	g.Expect(atomic.LoadInt32(&unreferenced.closed)).To(Equal(int32(1)))
+
+	runtime.KeepAlive(rec1)
+	runtime.KeepAlive(rec2)
+	runtime.KeepAlive(rec3)
+	runtime.KeepAlive(rec4)
+	runtime.KeepAlive(rec5)
+	runtime.KeepAlive(rec6)
+}
+
+func TestAutoCloseOnClose(t *testing.T) {
+	t.Run("slow close", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cache := weakcache.New(
+			weakcache.WithGCInterval(5*time.Millisecond),
+			weakcache.WithSyncEviction(),
+			weakcache.WithAutoClose(true),
+		)
+
+		a := &fakeCloser{delay: 20 * time.Millisecond}
+		b := &fakeCloser{delay: 20 * time.Millisecond}
+		cache.Preload(map[string]interface{}{"a": a, "b": b}, time.Millisecond, 0)
+
+		// The records expire while their values are closed.
+		cache.Close()
+		time.Sleep(20 * time.Millisecond)
+
+		g.Expect(atomic.LoadInt32(&a.closed)).To(Equal(int32(1)))
+		g.Expect(atomic.LoadInt32(&b.closed)).To(Equal(int32(1)))
+	})
+
+	t.Run("fetch during close", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cache := weakcache.New(
+			weakcache.WithGCInterval(10*time.Millisecond),
+			weakcache.WithAutoClose(true),
+		)
+
+		value := &fakeCloser{}
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		result := cache.FetchAsync("key", time.Minute, 0, func() (interface{}, error) {
+			close(started)
+			<-release
+			return value, nil
+		})
+
+		<-started
+		cache.Close()
+		close(release)
+
+		// The value fetched for the closed cache is closed.
+		g.Expect((<-result).Err).To(MatchError(weakcache.ErrClosed))
+		g.Expect(atomic.LoadInt32(&value.closed)).To(Equal(int32(1)))
+	})
+}
+
+func TestFetchTimeout(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithFetchTimeout(20*time.Millisecond),
+	)
+	defer cache.Close()
+
+	done := make(chan struct{})
+
+	start := time.Now()
+	rec, err := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+		defer close(done)
+		time.Sleep(100 * time.Millisecond)
+		return "value", nil
+	})
+
+	g.Expect(err).To(MatchError(weakcache.ErrFetchTimeout))
+	g.Expect(rec).To(BeNil())
+	g.Expect(time.Since(start)).To(BeNumerically("<", 100*time.Millisecond))
+
+	// The result of the abandoned fallback is discarded.
+	<-done
+	g.Consistently(func() int {
+		return cache.Len()
+	}, 50*time.Millisecond).Should(Equal(0))
+}
+
+func TestFetchTimeoutWaiters(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithFetchTimeout(50*time.Millisecond),
+	)
+	defer cache.Close()
+
+	fetch := func() (interface{}, error) {
+		time.Sleep(70 * time.Millisecond)
+		return "value", nil
+	}
+
+	first := cache.FetchAsync("key", 0, 0, fetch)
+
+	time.Sleep(40 * time.Millisecond)
+
+	// The second caller waits for the same fallback.
+	second := cache.FetchAsync("key", 0, 0, func() (interface{}, error) {
+		panic("unexpected fetch fallback")
+	})
+
+	res := <-first
+	g.Expect(res.Err).To(MatchError(weakcache.ErrFetchTimeout))
+
+	// The timeout of the first caller does not abandon the second.
+	res = <-second
+	g.Expect(res.Err).NotTo(HaveOccurred())
+	g.Expect(res.Record.Value).To(Equal("value"))
+
+	g.Expect(cache.Len()).To(Equal(1))
+
+	runtime.KeepAlive(res.Record)
+
+	runtime.GC()
+
+	// The record is referenced only by the second caller.
+	g.Eventually(func() int {
+		return cache.Len()
+	}).Should(Equal(0))
+}
+
+// evictedKeys records the keys passed to an eviction callback.
+type evictedKeys struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+func (e *evictedKeys) add(key string, _ interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.keys = append(e.keys, key)
+}
+
+func (e *evictedKeys) get() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.keys...)
+}
+
+type sizedValue int64
+
+func (v sizedValue) Size() int64 {
+	return int64(v)
+}
+
+func TestMaxBytes(t *testing.T) {
+	g := NewWithT(t)
+
+	evicted := &evictedKeys{}
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSyncEviction(),
+		weakcache.WithMaxBytes(100),
+		weakcache.WithEvictionCallback(evicted.add),
+	)
+	defer cache.Close()
+
+	fetch := func(key string) *weakcache.Record {
+		rec, err := cache.Fetch(key, time.Minute, 0, func() (interface{}, error) {
+			return sizedValue(40), nil
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		return rec
+	}
+
+	// Unreference "a" and "b" in order.
+	for i, key := range []string{"a", "b"} {
+		fetch(key)
+
+		runtime.GC()
+
+		g.Eventually(func() int {
+			_, unreachable := cache.Counts()
+			return unreachable
+		}).Should(Equal(i + 1))
+	}
+
+	g.Expect(evicted.get()).To(BeEmpty())
+
+	// Exceed the budget, evicting the least recently unreferenced record.
+	recC := fetch("c")
+
+	g.Eventually(evicted.get).Should(Equal([]string{"a"}))
+
+	g.Expect(cache.Contains("b")).To(BeTrue())
+	g.Expect(cache.Contains("c")).To(BeTrue())
+
+	// Referenced records are never evicted for size.
+	recD := fetch("d")
+	recE := fetch("e")
+
+	g.Expect(evicted.get()).To(Equal([]string{"a", "b"}))
+	g.Expect(cache.Len()).To(Equal(3))
+
+	runtime.KeepAlive(recC)
+	runtime.KeepAlive(recD)
+	runtime.KeepAlive(recE)
+}
+
+func TestEvictionPolicyLFU(t *testing.T) {
+	for _, tc := range []struct {
+		policy  weakcache.EvictionPolicy
+		evicted string
+	}{
+		{weakcache.LRU, "hot"},
+		{weakcache.LFU, "rare"},
+	} {
+		g := NewWithT(t)
+
+		evicted := &evictedKeys{}
+
+		cache := weakcache.New(
+			weakcache.WithGCInterval(10*time.Millisecond),
+			weakcache.WithSyncEviction(),
+			weakcache.WithMaxBytes(100),
+			weakcache.WithEvictionPolicy(tc.policy),
+			weakcache.WithEvictionCallback(evicted.add),
+		)
+
+		fetch := func(key string) *weakcache.Record {
+			rec, err := cache.Fetch(key, time.Minute, 0, func() (interface{}, error) {
+				return sizedValue(40), nil
+			})
+			g.Expect(err).NotTo(HaveOccurred())
+			return rec
+		}
+
+		unreferenced := func(n int) {
+			runtime.GC()
+			g.Eventually(func() int {
+				_, unreachable := cache.Counts()
+				return unreachable
+			}).Should(Equal(n))
+		}
+
+		// "hot" is accessed often but unreferenced before "rare".
+		for i := 0; i < 5; i++ {
+			fetch("hot")
+		}
+		unreferenced(1)
+
+		fetch("rare")
+		unreferenced(2)
+
+		// Exceed the budget.
+		rec := fetch("new")
+
+		g.Eventually(evicted.get).Should(Equal([]string{tc.evicted}))
+		g.Expect(cache.Len()).To(Equal(2))
+
+		runtime.KeepAlive(rec)
+		cache.Close()
+	}
+}
+
+func TestMaxBytesMixedValues(t *testing.T) {
+	g := NewWithT(t)
+
+	evicted := &evictedKeys{}
+
+	cache := weakcache.New(
+		weakcache.WithSyncEviction(),
+		weakcache.WithMaxBytes(10),
+		weakcache.WithEvictionCallback(evicted.add),
+	)
+	defer cache.Close()
+
+	// Values which do not implement Sizer take no bytes.
+	for _, entry := range []struct {
+		key   string
+		value interface{}
+	}{
+		{"plain", "plain"},
+		{"big1", sizedValue(8)},
+		{"big2", sizedValue(8)},
+	} {
+		cache.Preload(map[string]interface{}{entry.key: entry.value}, time.Minute, 0)
+	}
+
+	g.Expect(evicted.get()).To(Equal([]string{"big1"}))
+	g.Expect(cache.Contains("plain")).To(BeTrue())
+	g.Expect(cache.Contains("big2")).To(BeTrue())
+}
+
+func TestMaxBytesReferencedOverLimit(t *testing.T) {
+	g := NewWithT(t)
+
+	evicted := &evictedKeys{}
+
+	cache := weakcache.New(
+		weakcache.WithSyncEviction(),
+		weakcache.WithMaxBytes(100),
+		weakcache.WithEvictionCallback(evicted.add),
+	)
+	defer cache.Close()
+
+	var recs []*weakcache.Record
+	for _, key := range []string{"a", "b", "c"} {
+		recs = append(recs, cache.Store(key, sizedValue(40), time.Minute, 0))
+	}
+
+	// Evicting the unreferenced record would not bring the size within the limit.
+	cache.Preload(map[string]interface{}{"d": sizedValue(10)}, time.Minute, 0)
+
+	g.Expect(evicted.get()).To(BeEmpty())
+	g.Expect(cache.Contains("d")).To(BeTrue())
+	g.Expect(cache.Verify()).To(Succeed())
+
+	runtime.KeepAlive(recs)
+}
+
+func TestFetchWeighted(t *testing.T) {
+	g := NewWithT(t)
+
+	evicted := &evictedKeys{}
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithMaxBytes(100),
+		weakcache.WithEvictionCallback(evicted.add),
+	)
+	defer cache.Close()
+
+	fetch := func(key string, weight int64) *weakcache.Record {
+		rec, err := cache.FetchWeighted(key, weight, time.Minute, 0, func() (interface{}, error) {
+			return sizedValue(40), nil
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		return rec
+	}
+
+	// Unreference the heavy record first.
+	for i, key := range []string{"heavy", "light"} {
+		weight := int64(10)
+		if key == "light" {
+			weight = 1
+		}
+		fetch(key, weight)
+
+		runtime.GC()
+
+		g.Eventually(func() int {
+			_, unreachable := cache.Counts()
+			return unreachable
+		}).Should(Equal(i + 1))
+	}
+
+	g.Expect(cache.Stats().TotalWeight).To(Equal(int64(11)))
+
+	// Exceed the budget, evicting the low-weight record
+	// although it was unreferenced more recently.
+	rec := fetch("c", 5)
+
+	g.Eventually(evicted.get).Should(Equal([]string{"light"}))
+	g.Expect(cache.Contains("heavy")).To(BeTrue())
+	g.Expect(cache.Stats().TotalWeight).To(Equal(int64(15)))
+
+	runtime.KeepAlive(rec)
+}
+
+func TestSoftMaxTTL(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSoftMaxTTL(true),
+	)
+	defer cache.Close()
+
+	calls := 0
+	fetch := func() (interface{}, error) {
+		calls++
+		v := calls
+		return &v, nil
+	}
+
+	rec1, err := cache.Fetch("key", 0, 50*time.Millisecond, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	time.Sleep(80 * time.Millisecond)
+
+	// The record is past maxTTL but still referenced.
+	rec2, err := cache.Fetch("key", 0, 50*time.Millisecond, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(calls).To(Equal(1))
+	g.Expect(rec2.Value).To(BeIdenticalTo(rec1.Value))
+	g.Expect(cache.Contains("key")).To(BeTrue())
+
+	runtime.KeepAlive(rec1)
+	runtime.KeepAlive(rec2)
+	runtime.GC()
+
+	// Once unreferenced, the expired record is evicted.
+	g.Eventually(func() int {
+		return cache.Len()
+	}).Should(Equal(0))
+
+	rec3, err := cache.Fetch("key", 0, 50*time.Millisecond, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(calls).To(Equal(2))
+	g.Expect(*rec3.Value.(*int)).To(Equal(2))
+}
+
+func TestLogger(t *testing.T) {
+	g := NewWithT(t)
+
+	var buf bytes.Buffer
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSyncEviction(),
+		weakcache.WithLogger(slog.New(slog.NewTextHandler(&buf, nil))),
+		weakcache.WithEvictionCallback(func(key string, value interface{}) {
+			panic("callback failed")
+		}),
+	)
+	defer cache.Close()
+
+	rec1 := cache.Store("key", "old value", 0, 0)
+
+	// Replacing the record runs the eviction callback
+	// in the calling goroutine.
+	rec2 := cache.Store("key", "new value", 0, 0)
+
+	g.Expect(buf.String()).To(ContainSubstring("weakcache: eviction callback panicked"))
+	g.Expect(buf.String()).To(ContainSubstring("panic=\"callback failed\""))
+
+	runtime.KeepAlive(rec1)
+	runtime.KeepAlive(rec2)
+}
+
+func TestFetchRetry(t *testing.T) {
+	g := NewWithT(t)
+
+	var backoffs []int
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithFetchRetry(3, func(attempt int) time.Duration {
+			backoffs = append(backoffs, attempt)
+			return time.Millisecond
+		}),
+	)
+	defer cache.Close()
+
+	calls := 0
+	fetch := func() (interface{}, error) {
+		calls++
+		if calls < 3 {
+			return nil, errors.New("transient error")
+		}
+		return "value", nil
+	}
+
+	rec1, err := cache.Fetch("key", time.Minute, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec1.Value).To(Equal("value"))
+	g.Expect(calls).To(Equal(3))
+	g.Expect(backoffs).To(Equal([]int{1, 2}))
+
+	// The success is cached.
+	rec2, err := cache.Fetch("key", time.Minute, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec2.Value).To(Equal("value"))
+	g.Expect(calls).To(Equal(3))
+
+	runtime.KeepAlive(rec1)
+	runtime.KeepAlive(rec2)
+}
+
+func TestFetchRetryExhausted(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithFetchRetry(2, nil),
+	)
+	defer cache.Close()
+
+	calls := 0
+	_, err := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+		calls++
+		return nil, fmt.Errorf("error %d", calls)
+	})
+	g.Expect(err).To(MatchError("error 2"))
+	g.Expect(calls).To(Equal(2))
+	g.Expect(cache.Len()).To(Equal(0))
+}
+
+func TestFetchRetryContext(t *testing.T) {
+	t.Run("timeout", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cache := weakcache.New(
+			weakcache.WithGCInterval(10*time.Millisecond),
+			weakcache.WithFetchTimeout(20*time.Millisecond),
+			weakcache.WithFetchRetry(1000, nil),
+		)
+		defer cache.Close()
+
+		var calls int32
+		_, err := cache.Fetch("key", 0, 0, func() (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(5 * time.Millisecond)
+			return nil, errors.New("transient error")
+		})
+		g.Expect(err).To(HaveOccurred())
+
+		// The retries stop at the timeout.
+		g.Eventually(func() int32 {
+			return atomic.LoadInt32(&calls)
+		}).Should(BeNumerically("<", 10))
+		n := atomic.LoadInt32(&calls)
+		g.Consistently(func() int32 {
+			return atomic.LoadInt32(&calls)
+		}, 30*time.Millisecond).Should(BeNumerically("<=", n+1))
+	})
+
+	t.Run("waiter gives up", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cache := weakcache.New(
+			weakcache.WithGCInterval(10*time.Millisecond),
+			weakcache.WithFetchRetry(5, func(int) time.Duration {
+				return 5 * time.Millisecond
+			}),
+		)
+		defer cache.Close()
+
+		started := make(chan struct{})
+		var calls int32
+		fetch := func(context.Context) (interface{}, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				close(started)
+			}
+			if atomic.LoadInt32(&calls) < 3 {
+				return nil, errors.New("transient error")
+			}
+			return "value", nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := cache.FetchContext(ctx, "key", time.Minute, 0, fetch)
+			errCh <- err
+		}()
+
+		<-started
+
+		// The first caller giving up does not stop the retries
+		// for the second caller.
+		rec, err := cache.FetchContext(context.Background(), "key", time.Minute, 0, fetch)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(rec.Value).To(Equal("value"))
+		g.Expect(<-errCh).To(MatchError(context.DeadlineExceeded))
+
+		runtime.KeepAlive(rec)
+	})
+
+	t.Run("all waiters give up", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cache := weakcache.New(
+			weakcache.WithGCInterval(10*time.Millisecond),
+			weakcache.WithFetchRetry(100, func(int) time.Duration {
+				return 5 * time.Millisecond
+			}),
+		)
+		defer cache.Close()
+
+		var calls int32
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+
+		_, err := cache.FetchContext(ctx, "key", time.Minute, 0, func(context.Context) (interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			return nil, errors.New("transient error")
+		})
+		g.Expect(err).To(MatchError(context.DeadlineExceeded))
+
+		// The fallback is no longer called once the only waiter gave up.
+		time.Sleep(10 * time.Millisecond)
+		n := atomic.LoadInt32(&calls)
+		g.Consistently(func() int32 {
+			return atomic.LoadInt32(&calls)
+		}, 50*time.Millisecond).Should(Equal(n))
+		g.Expect(n).To(BeNumerically("<=", 3))
+	})
+}
+
+func TestCacheNil(t *testing.T) {
+	t.Run("enabled", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+		defer cache.Close()
+
+		rec1, err := cache.Fetch("key", time.Minute, 0, func() (interface{}, error) {
+			return nil, nil
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(rec1.Value).To(BeNil())
+
+		rec2, err := cache.Fetch("key", time.Minute, 0, func() (interface{}, error) {
+			panic("unexpected fetch fallback")
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(rec2.Value).To(BeNil())
+
+		runtime.KeepAlive(rec1)
+		runtime.KeepAlive(rec2)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cache := weakcache.New(
+			weakcache.WithGCInterval(10*time.Millisecond),
+			weakcache.WithCacheNil(false),
+		)
+		defer cache.Close()
+
+		calls := 0
+		fetch := func() (interface{}, error) {
+			calls++
+			return nil, nil
+		}
+
+		for i := 0; i < 2; i++ {
+			rec, err := cache.Fetch("key", time.Minute, 0, fetch)
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(rec.Value).To(BeNil())
+		}
+
+		g.Expect(calls).To(Equal(2))
+		g.Expect(cache.Len()).To(Equal(0))
+
+		// A typed nil is not an untyped nil interface value.
+		rec1, err := cache.Fetch("typed", time.Minute, 0, func() (interface{}, error) {
+			return (*int)(nil), nil
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(rec1.Value).To(Equal((*int)(nil)))
+		g.Expect(cache.Contains("typed")).To(BeTrue())
+
+		runtime.KeepAlive(rec1)
+	})
+}
+
+func TestDefaultTTL(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithDefaultTTL(time.Minute, 200*time.Millisecond),
+	)
+	defer cache.Close()
+
+	calls := 0
+	fetch := func() (interface{}, error) {
+		calls++
+		return calls, nil
+	}
+
+	rec, err := cache.FetchDefault("key", fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.Value).To(Equal(1))
+
+	runtime.KeepAlive(rec)
+	cache.Sync()
+
+	// The unreferenced record survives due to minTTL.
+	rec, err = cache.FetchDefault("key", fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.Value).To(Equal(1))
+
+	time.Sleep(250 * time.Millisecond)
+
+	// The record expired due to maxTTL.
+	rec, err = cache.FetchDefault("key", fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.Value).To(Equal(2))
+
+	runtime.KeepAlive(rec)
+}
+
+func TestFetchLatency(t *testing.T) {
+	fetch := func() (interface{}, error) {
+		time.Sleep(50 * time.Millisecond)
+		return "value", nil
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+		defer cache.Close()
+
+		for _, key := range []string{"a", "b"} {
+			_, err := cache.Fetch(key, 0, 0, fetch)
+			g.Expect(err).NotTo(HaveOccurred())
+		}
+
+		stats := cache.Stats()
+		g.Expect(stats.Fetches).To(Equal(uint64(2)))
+		g.Expect(stats.FetchDuration).To(BeNumerically(">=", 100*time.Millisecond))
+		g.Expect(stats.MaxFetchDuration).To(BeNumerically(">=", 50*time.Millisecond))
+		g.Expect(stats.MaxFetchDuration).To(BeNumerically("<=", stats.FetchDuration))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cache := weakcache.New(
+			weakcache.WithGCInterval(10*time.Millisecond),
+			weakcache.WithFetchLatency(false),
+		)
+		defer cache.Close()
+
+		_, err := cache.Fetch("a", 0, 0, fetch)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		stats := cache.Stats()
+		g.Expect(stats.Fetches).To(BeZero())
+		g.Expect(stats.FetchDuration).To(BeZero())
+	})
+}
+
+func TestSyncEviction(t *testing.T) {
+	g := NewWithT(t)
+
+	evicted := &evictedKeys{}
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSyncEviction(),
+		weakcache.WithEvictionCallback(evicted.add),
+	)
+	defer cache.Close()
+
+	var recs []*weakcache.Record
+	for i := 0; i < 5; i++ {
+		recs = append(recs, cache.Store(fmt.Sprintf("key%d", i), i, 0, 0))
+	}
+
+	// The callbacks have run in eviction order before Store returns.
+	for i := 0; i < 5; i++ {
+		recs = append(recs, cache.Store(fmt.Sprintf("key%d", i), i, 0, 0))
+		g.Expect(evicted.get()).To(HaveLen(i + 1))
+	}
+
+	g.Expect(evicted.get()).To(Equal([]string{"key0", "key1", "key2", "key3", "key4"}))
+
+	runtime.KeepAlive(recs)
+}
+
+func TestAsyncEviction(t *testing.T) {
+	g := NewWithT(t)
+
+	evicted := &evictedKeys{}
+
+	release := make(chan struct{})
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithEvictionCallback(func(key string, value interface{}) {
+			<-release
+			evicted.add(key, value)
+		}),
+	)
+	defer cache.Close()
+
+	var recs []*weakcache.Record
+	for i := 0; i < 3; i++ {
+		recs = append(recs, cache.Store(fmt.Sprintf("key%d", i), i, 0, 0))
+	}
+
+	// A blocked callback does not block the caller.
+	for i := 0; i < 3; i++ {
+		recs = append(recs, cache.Store(fmt.Sprintf("key%d", i), i, 0, 0))
+	}
+
+	g.Expect(evicted.get()).To(BeEmpty())
+
+	close(release)
+
+	g.Eventually(evicted.get).Should(Equal([]string{"key0", "key1", "key2"}))
+
+	runtime.KeepAlive(recs)
+}
+
+func TestEvictionFilter(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithEvictionFilter(func(key string, value interface{}) bool {
+			return key != "keep"
+		}),
+	)
+	defer cache.Close()
+
+	calls := 0
+	fetch := func() (interface{}, error) {
+		calls++
+		return "value", nil
+	}
+
+	for _, key := range []string{"keep", "drop"} {
+		_, err := cache.Fetch(key, 20*time.Millisecond, 0, fetch)
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+
+	cache.Sync()
+
+	g.Eventually(func() int {
+		return cache.Len()
+	}).Should(Equal(1))
+
+	// The filter keeps granting the vetoed record another grace period.
+	g.Consistently(func() int {
+		return cache.Len()
+	}, 100*time.Millisecond).Should(Equal(1))
+
+	calls = 0
+	rec, err := cache.Fetch("keep", 20*time.Millisecond, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.Value).To(Equal("value"))
+	g.Expect(calls).To(Equal(0))
+}
+
+func TestValidator(t *testing.T) {
+	g := NewWithT(t)
+
+	type conn struct {
+		closed atomic.Bool
+	}
+
+	evicted := &evictedKeys{}
+
+	cache := weakcache.New(
+		weakcache.WithSyncEviction(),
+		weakcache.WithEvictionCallback(evicted.add),
+		weakcache.WithValidator(func(value interface{}) bool {
+			return !value.(*conn).closed.Load()
+		}),
+	)
+	defer cache.Close()
+
+	calls := 0
+	fetch := func() (interface{}, error) {
+		calls++
+		return &conn{}, nil
+	}
+
+	rec, err := cache.Fetch("conn", time.Minute, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	first := rec.Value.(*conn)
+
+	rec, err = cache.Fetch("conn", time.Minute, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.Value).To(BeIdenticalTo(first))
+	g.Expect(calls).To(Equal(1))
+
+	// The server closed the connection.
+	first.closed.Store(true)
+
+	rec, err = cache.Fetch("conn", time.Minute, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.Value).NotTo(BeIdenticalTo(first))
+	g.Expect(rec.Value.(*conn).closed.Load()).To(BeFalse())
+	g.Expect(calls).To(Equal(2))
+	g.Expect(evicted.get()).To(Equal([]string{"conn"}))
+}
+
+func BenchmarkInitialCapacity(b *testing.B) {
+	const size = 100000
+
+	keys := make([]string, size)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+
+	for _, capacity := range []int{0, size} {
+		b.Run(fmt.Sprintf("capacity=%d", capacity), func(b *testing.B) {
+			b.ReportAllocs()
+
+			for i := 0; i < b.N; i++ {
+				cache := weakcache.New(
+					weakcache.WithGCInterval(0),
+					weakcache.WithInitialCapacity(capacity),
+				)
+				for _, key := range keys {
+					cache.Store(key, key, time.Hour, 0)
+				}
+				cache.Close()
+			}
+		})
+	}
+}
+
+func TestServeStaleOnError(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithServeStaleOnError(100*time.Millisecond),
+	)
+	defer cache.Close()
+
+	errBackend := errors.New("backend down")
+
+	rec, err := cache.Fetch("key", time.Hour, 50*time.Millisecond, func() (interface{}, error) {
+		return "value", nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.Stale(time.Now())).To(BeFalse())
+
+	failing := func() (interface{}, error) {
+		return nil, errBackend
+	}
+
+	time.Sleep(70 * time.Millisecond)
+
+	// The record expired within the stale window.
+	stale, err := cache.Fetch("key", time.Hour, 50*time.Millisecond, failing)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(stale.Value).To(Equal("value"))
+	g.Expect(stale.Stale(time.Now())).To(BeTrue())
+
+	time.Sleep(100 * time.Millisecond)
+
+	// The stale window has passed.
+	_, err = cache.Fetch("key", time.Hour, 50*time.Millisecond, failing)
+	g.Expect(err).To(MatchError(errBackend))
+
+	runtime.KeepAlive(rec)
+	runtime.KeepAlive(stale)
+}
+
+func TestSlidingGrace(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []weakcache.Option
+		hotCalls int
+	}{
+		// The revived record still expires minTTL after it was unreferenced.
+		{"fixed", nil, 2},
+		// Each hit restarts the grace period of the revived record.
+		{"sliding", []weakcache.Option{weakcache.WithSlidingGrace()}, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cache := weakcache.New(append(tc.opts, weakcache.WithGCInterval(10*time.Millisecond))...)
+			defer cache.Close()
+
+			calls := map[string]int{}
+			fetch := func(key string) *weakcache.Record {
+				rec, err := cache.Fetch(key, 50*time.Millisecond, 0, func() (interface{}, error) {
+					calls[key]++
+					return "value", nil
+				})
+				g.Expect(err).NotTo(HaveOccurred())
+				return rec
+			}
+
+			fetch("hot")
+			fetch("cold")
+			cache.Sync()
+
+			// Keep accessing the hot key for longer than minTTL.
+			var recs []*weakcache.Record
+			for start := time.Now(); time.Since(start) < 150*time.Millisecond; {
+				recs = append(recs, fetch("hot"))
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			g.Expect(cache.Contains("hot")).To(BeTrue())
+			g.Expect(cache.Contains("cold")).To(BeFalse())
+			g.Expect(calls["hot"]).To(Equal(tc.hotCalls))
+			g.Expect(calls["cold"]).To(Equal(1))
+
+			runtime.KeepAlive(recs)
+		})
+	}
+}
+
+func TestLeakDetection(t *testing.T) {
+	g := NewWithT(t)
+
+	var buf bytes.Buffer
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithLeakDetection(50*time.Millisecond),
+		weakcache.WithLogger(slog.New(slog.NewTextHandler(&buf, nil))),
+	)
+
+	leaked := cache.Store("leaked", "value", time.Minute, 0)
+	cache.Store("released", "value", time.Minute, 0)
+	cache.Sync()
+
+	g.Eventually(func() uint64 {
+		return cache.Stats().SuspectedLeaks
+	}).Should(Equal(uint64(1)))
+
+	// A leaked record is counted once.
+	g.Consistently(func() uint64 {
+		return cache.Stats().SuspectedLeaks
+	}, 50*time.Millisecond).Should(Equal(uint64(1)))
+
+	g.Expect(cache.CloseContext(context.Background())).To(Succeed())
+
+	g.Expect(buf.String()).To(ContainSubstring("weakcache: suspected reference leak"))
+	g.Expect(buf.String()).To(ContainSubstring("key=leaked"))
+	g.Expect(buf.String()).NotTo(ContainSubstring("key=released"))
+
+	runtime.KeepAlive(leaked)
+}
+
+func TestSlidingMaxTTL(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSlidingMaxTTL(),
+	)
+	defer cache.Close()
+
+	calls := map[string]int{}
+	fetch := func(key string) *weakcache.Record {
+		rec, err := cache.Fetch(key, time.Minute, 50*time.Millisecond, func() (interface{}, error) {
+			calls[key]++
+			return "value", nil
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		return rec
+	}
+
+	recs := []*weakcache.Record{fetch("active"), fetch("idle")}
+
+	// Keep fetching the active key for longer than maxTTL.
+	for start := time.Now(); time.Since(start) < 150*time.Millisecond; {
+		recs = append(recs, fetch("active"))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	g.Expect(cache.Contains("active")).To(BeTrue())
+	g.Expect(cache.Contains("idle")).To(BeFalse())
+	g.Expect(calls["active"]).To(Equal(1))
+
+	runtime.KeepAlive(recs)
+}
+
+func TestReplaceCallback(t *testing.T) {
+	g := NewWithT(t)
+
+	type replacement struct {
+		key                string
+		oldValue, newValue interface{}
+	}
+
+	var replaced []replacement
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithSyncEviction(),
+		weakcache.WithReplaceCallback(func(key string, oldValue, newValue interface{}) {
+			replaced = append(replaced, replacement{key, oldValue, newValue})
+		}),
+	)
+	defer cache.Close()
+
+	rec1 := cache.Store("stored", "old value", 0, 0)
+	rec2 := cache.Store("stored", "new value", 0, 0)
+
+	g.Expect(replaced).To(Equal([]replacement{
+		{"stored", "old value", "new value"},
+	}))
+
+	rec3 := cache.Store("expiring", "value", 0, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+
+	g.Expect(cache.Contains("expiring")).To(BeFalse())
+
+	// The record past its maxTTL is replaced by the fetch.
+	rec4, err := cache.Fetch("expiring", 0, 0, func() (interface{}, error) {
+		return "fetched value", nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec4.Value).To(Equal("fetched value"))
+
+	g.Expect(replaced).To(Equal([]replacement{
+		{"stored", "old value", "new value"},
+		{"expiring", "value", "fetched value"},
+	}))
+	g.Expect(cache.Verify()).To(Succeed())
+
+	runtime.KeepAlive(rec1)
+	runtime.KeepAlive(rec2)
+	runtime.KeepAlive(rec3)
+	runtime.KeepAlive(rec4)
+}
+
+func TestFetchDeadline(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(
+		weakcache.WithGCInterval(10*time.Millisecond),
+		weakcache.WithFetchDeadline(0.5),
+	)
+	defer cache.Close()
+
+	slow := func(ctx context.Context) (interface{}, error) {
+		select {
+		case <-time.After(time.Second):
+			return "value", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	// The fallback is canceled after half of maxTTL.
+	start := time.Now()
+	_, err := cache.FetchContext(context.Background(), "key", 0, 100*time.Millisecond, slow)
+	g.Expect(err).To(MatchError(context.DeadlineExceeded))
+	g.Expect(time.Since(start)).To(BeNumerically("~", 50*time.Millisecond, 40*time.Millisecond))
+
+	// An earlier deadline of the caller's context takes precedence.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	deadlines := make(chan time.Time, 1)
+	_, err = cache.FetchContext(ctx, "key", 0, time.Hour, func(fetchCtx context.Context) (interface{}, error) {
+		deadline, _ := fetchCtx.Deadline()
+		deadlines <- deadline
+		return slow(fetchCtx)
+	})
+	g.Expect(err).To(MatchError(context.DeadlineExceeded))
+
+	ctxDeadline, _ := ctx.Deadline()
+	g.Expect(<-deadlines).To(Equal(ctxDeadline))
+}
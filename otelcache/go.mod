@@ -0,0 +1,30 @@
+module github.com/mgnsk/weakcache/otelcache
+
+go 1.25.0
+
+require (
+	github.com/mgnsk/weakcache v0.0.0-20261015101808-482a447705c4
+	github.com/onsi/gomega v1.9.0
+	go.opentelemetry.io/otel v1.46.0
+	go.opentelemetry.io/otel/sdk v1.46.0
+	go.opentelemetry.io/otel/trace v1.46.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/go-logr/logr v1.4.4 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	go.opentelemetry.io/auto/sdk v1.2.1 // indirect
+	go.opentelemetry.io/otel/metric v1.46.0 // indirect
+	golang.org/x/net v0.0.0-20180906233101-161cd47e91fd // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.3.0 // indirect
+	golang.org/x/xerrors v0.0.0-20190717185122-a985d3407aa7 // indirect
+	gopkg.in/yaml.v2 v2.2.4 // indirect
+)
+
+// The root module is developed in the same repository. The replacement
+// applies only when building this module itself.
+replace github.com/mgnsk/weakcache => ../
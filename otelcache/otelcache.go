@@ -0,0 +1,80 @@
+// Package otelcache traces weakcache fetch fallbacks with OpenTelemetry.
+package otelcache
+
+import (
+	"context"
+	"encoding/hex"
+	"hash/fnv"
+	"time"
+
+	"github.com/mgnsk/weakcache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// SpanName is the name of the span started around a fetch fallback.
+const SpanName = "weakcache.fetch"
+
+const tracerName = "github.com/mgnsk/weakcache/otelcache"
+
+// Option configures a Cache.
+type Option func(*Cache)
+
+// WithHashedKeys records a hash of the key instead of the key
+// in the span attributes, for keys which contain sensitive data.
+func WithHashedKeys() Option {
+	return func(c *Cache) {
+		c.hashKeys = true
+	}
+}
+
+// Cache wraps a weakcache.Cache, tracing its fetch fallbacks.
+type Cache struct {
+	*weakcache.Cache
+	tracer   trace.Tracer
+	hashKeys bool
+}
+
+// New returns c wrapped with tracing using a tracer from tp.
+func New(c *weakcache.Cache, tp trace.TracerProvider, opts ...Option) *Cache {
+	tc := &Cache{
+		Cache:  c,
+		tracer: tp.Tracer(tracerName),
+	}
+
+	for _, opt := range opts {
+		opt(tc)
+	}
+
+	return tc
+}
+
+// FetchContext is like weakcache.Cache.FetchContext but starts a span around
+// the fallback on a cache miss. The span is a child of the span in ctx.
+func (c *Cache) FetchContext(ctx context.Context, key string, minTTL, maxTTL time.Duration, fetch func(ctx context.Context) (interface{}, error)) (*weakcache.Record, error) {
+	return c.Cache.FetchContext(ctx, key, minTTL, maxTTL, func(ctx context.Context) (interface{}, error) {
+		ctx, span := c.tracer.Start(ctx, SpanName, trace.WithAttributes(
+			attribute.String("weakcache.key", c.keyAttr(key)),
+			attribute.Bool("weakcache.hit", false),
+		))
+		defer span.End()
+
+		value, err := fetch(ctx)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		return value, err
+	})
+}
+
+func (c *Cache) keyAttr(key string) string {
+	if !c.hashKeys {
+		return key
+	}
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return hex.EncodeToString(h.Sum(nil))
+}
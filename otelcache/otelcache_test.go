@@ -0,0 +1,71 @@
+package otelcache_test
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mgnsk/weakcache"
+	"github.com/mgnsk/weakcache/otelcache"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestFetchContext(t *testing.T) {
+	g := NewWithT(t)
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	cache := otelcache.New(weakcache.New(weakcache.WithGCInterval(10*time.Millisecond)), tp)
+	defer cache.Close()
+
+	fetch := func(ctx context.Context) (interface{}, error) {
+		return "value", nil
+	}
+
+	// A miss starts a span around the fallback.
+	rec1, err := cache.FetchContext(context.Background(), "key", time.Minute, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec1.Value).To(Equal("value"))
+
+	spans := recorder.Ended()
+	g.Expect(spans).To(HaveLen(1))
+	g.Expect(spans[0].Name()).To(Equal(otelcache.SpanName))
+	g.Expect(spans[0].Attributes()).To(ConsistOf(
+		attribute.String("weakcache.key", "key"),
+		attribute.Bool("weakcache.hit", false),
+	))
+
+	// A hit does not.
+	rec2, err := cache.FetchContext(context.Background(), "key", time.Minute, 0, fetch)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec2.Value).To(Equal("value"))
+
+	g.Expect(recorder.Ended()).To(HaveLen(1))
+
+	runtime.KeepAlive(rec1)
+	runtime.KeepAlive(rec2)
+}
+
+func TestHashedKeys(t *testing.T) {
+	g := NewWithT(t)
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	cache := otelcache.New(weakcache.New(weakcache.WithGCInterval(10*time.Millisecond)), tp, otelcache.WithHashedKeys())
+	defer cache.Close()
+
+	_, err := cache.FetchContext(context.Background(), "secret", 0, 0, func(ctx context.Context) (interface{}, error) {
+		return "value", nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	spans := recorder.Ended()
+	g.Expect(spans).To(HaveLen(1))
+	g.Expect(spans[0].Attributes()).NotTo(ContainElement(attribute.String("weakcache.key", "secret")))
+}
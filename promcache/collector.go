@@ -0,0 +1,64 @@
+// Package promcache exports weakcache statistics as Prometheus metrics.
+package promcache
+
+import (
+	"github.com/mgnsk/weakcache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	sizeDesc = prometheus.NewDesc(
+		"weakcache_size",
+		"Number of cached records.",
+		nil, nil,
+	)
+	recordsDesc = prometheus.NewDesc(
+		"weakcache_records",
+		"Number of cached records by reachability.",
+		[]string{"state"}, nil,
+	)
+	hitsDesc = prometheus.NewDesc(
+		"weakcache_hits_total",
+		"Number of fetches served from the cache.",
+		nil, nil,
+	)
+	missesDesc = prometheus.NewDesc(
+		"weakcache_misses_total",
+		"Number of fetches not served from the cache.",
+		nil, nil,
+	)
+	evictionsDesc = prometheus.NewDesc(
+		"weakcache_evictions_total",
+		"Number of evicted records.",
+		nil, nil,
+	)
+)
+
+type collector struct {
+	cache *weakcache.Cache
+}
+
+// NewCollector returns a collector which reports the statistics of c.
+func NewCollector(c *weakcache.Cache) prometheus.Collector {
+	return &collector{cache: c}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sizeDesc
+	ch <- recordsDesc
+	ch <- hitsDesc
+	ch <- missesDesc
+	ch <- evictionsDesc
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	reachable, unreachable := c.cache.Counts()
+	stats := c.cache.Stats()
+
+	ch <- prometheus.MustNewConstMetric(sizeDesc, prometheus.GaugeValue, float64(reachable+unreachable))
+	ch <- prometheus.MustNewConstMetric(recordsDesc, prometheus.GaugeValue, float64(reachable), "reachable")
+	ch <- prometheus.MustNewConstMetric(recordsDesc, prometheus.GaugeValue, float64(unreachable), "unreachable")
+	ch <- prometheus.MustNewConstMetric(hitsDesc, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(missesDesc, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(evictionsDesc, prometheus.CounterValue, float64(stats.Evictions))
+}
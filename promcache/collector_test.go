@@ -0,0 +1,65 @@
+package promcache_test
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mgnsk/weakcache"
+	"github.com/mgnsk/weakcache/promcache"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	for i := 0; i < 2; i++ {
+		rec, _ := cache.Fetch("key", time.Minute, 0, func() (interface{}, error) {
+			return "value", nil
+		})
+		g.Expect(rec.Value).To(Equal("value"))
+		runtime.KeepAlive(rec)
+	}
+
+	reg := prometheus.NewPedanticRegistry()
+	g.Expect(reg.Register(promcache.NewCollector(cache))).To(Succeed())
+
+	families, err := reg.Gather()
+	g.Expect(err).NotTo(HaveOccurred())
+
+	var names []string
+	for _, f := range families {
+		names = append(names, f.GetName())
+	}
+
+	g.Expect(names).To(ConsistOf(
+		"weakcache_size",
+		"weakcache_records",
+		"weakcache_hits_total",
+		"weakcache_misses_total",
+		"weakcache_evictions_total",
+	))
+
+	expected := `
+# HELP weakcache_hits_total Number of fetches served from the cache.
+# TYPE weakcache_hits_total counter
+weakcache_hits_total 1
+# HELP weakcache_misses_total Number of fetches not served from the cache.
+# TYPE weakcache_misses_total counter
+weakcache_misses_total 1
+# HELP weakcache_size Number of cached records.
+# TYPE weakcache_size gauge
+weakcache_size 1
+`
+	g.Expect(testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"weakcache_hits_total",
+		"weakcache_misses_total",
+		"weakcache_size",
+	)).To(Succeed())
+}
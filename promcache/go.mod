@@ -0,0 +1,29 @@
+module github.com/mgnsk/weakcache/promcache
+
+go 1.25.0
+
+require (
+	github.com/mgnsk/weakcache v0.0.0-20261015101808-482a447705c4
+	github.com/onsi/gomega v1.9.0
+	github.com/prometheus/client_golang v1.24.1
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.2 // indirect
+	github.com/prometheus/common v0.70.1 // indirect
+	github.com/prometheus/procfs v0.21.1 // indirect
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	golang.org/x/xerrors v0.0.0-20190717185122-a985d3407aa7 // indirect
+	google.golang.org/protobuf v1.36.11 // indirect
+	gopkg.in/yaml.v2 v2.2.4 // indirect
+)
+
+// The root module is developed in the same repository. The replacement
+// applies only when building this module itself.
+replace github.com/mgnsk/weakcache => ../
@@ -0,0 +1,94 @@
+package weakcache
+
+import "time"
+
+// Entry is a cache record in a snapshot.
+type Entry struct {
+	Key   string
+	Value interface{}
+	// MinTTL is the remaining time the record survives without being referenced.
+	MinTTL time.Duration
+	// MaxTTL is the remaining lifetime of the record. Zero means no limit.
+	MaxTTL time.Duration
+	// Weight is the eviction weight of the record.
+	Weight int64
+}
+
+// Snapshot returns the unexpired records of the cache.
+// Values are not copied.
+//
+// To persist a snapshot, the values must be serializable, for example
+// with encoding/json. Encoding is left to the caller.
+func (c *Cache) Snapshot() []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	entries := make([]Entry, 0, len(c.reachable)+len(c.unreachable))
+
+	for _, m := range []recordMap{c.reachable, c.unreachable} {
+		for _, rec := range m {
+			if rec.isExpired(now) {
+				continue
+			}
+			entry := Entry{
+				Key:    rec.key,
+				Value:  rec.Value,
+				MinTTL: time.Duration(rec.minTTL),
+				Weight: rec.weight,
+			}
+			if rec.lastUnref > 0 {
+				entry.MinTTL = time.Duration(rec.lastUnref + rec.minTTL - now)
+			}
+			if rec.expires > 0 {
+				entry.MaxTTL = time.Duration(rec.expires - now)
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+// Restore stores the entries of a snapshot as unreferenced records
+// with their remaining TTLs. Existing unexpired records are kept.
+func (c *Cache) Restore(entries []Entry) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	if c.closed {
+		return
+	}
+
+	now := time.Now().UnixNano()
+
+	for _, entry := range entries {
+		index := c.index(entry.Key)
+		if _, ok := c.peek(entry.Key, index, now); ok {
+			continue
+		}
+		c.insert(entry.Key, index, entry.Value, entry.Weight, "", entry.MinTTL, entry.MaxTTL, 0)
+	}
+}
+
+// Preload stores the entries as unreferenced records, so that they
+// survive for minTTL without being referenced. Existing unexpired
+// records are kept.
+func (c *Cache) Preload(entries map[string]interface{}, minTTL, maxTTL time.Duration) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	if c.closed {
+		return
+	}
+
+	now := time.Now().UnixNano()
+
+	for key, value := range entries {
+		index := c.index(key)
+		if _, ok := c.peek(key, index, now); ok {
+			continue
+		}
+		c.insert(key, index, value, 0, "", minTTL, maxTTL, 0)
+	}
+}
@@ -0,0 +1,99 @@
+package weakcache_test
+
+import (
+	"encoding/json"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/mgnsk/weakcache"
+	. "github.com/onsi/gomega"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	g := NewWithT(t)
+
+	cache1 := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache1.Close()
+
+	rec1, _ := cache1.Fetch("key1", time.Minute, 0, func() (interface{}, error) {
+		return "value1", nil
+	})
+	rec2, _ := cache1.Fetch("key2", time.Minute, time.Hour, func() (interface{}, error) {
+		return "value2", nil
+	})
+
+	g.Expect(rec1.Value).To(Equal("value1"))
+	g.Expect(rec2.Value).To(Equal("value2"))
+
+	entries := cache1.Snapshot()
+	g.Expect(entries).To(HaveLen(2))
+
+	for _, entry := range entries {
+		g.Expect(entry.MinTTL).To(Equal(time.Minute))
+		if entry.Key == "key2" {
+			g.Expect(entry.MaxTTL).To(BeNumerically("~", time.Hour, time.Second))
+		} else {
+			g.Expect(entry.MaxTTL).To(BeZero())
+		}
+	}
+
+	// Round-trip the snapshot through JSON.
+	b, err := json.Marshal(entries)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	var decoded []weakcache.Entry
+	g.Expect(json.Unmarshal(b, &decoded)).To(Succeed())
+
+	cache2 := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache2.Close()
+
+	cache2.Restore(decoded)
+
+	// Restored records start unreferenced.
+	reachable, unreachable := cache2.Counts()
+	g.Expect(reachable).To(Equal(0))
+	g.Expect(unreachable).To(Equal(2))
+
+	for key, value := range map[string]string{"key1": "value1", "key2": "value2"} {
+		rec, err := cache2.Fetch(key, time.Minute, 0, func() (interface{}, error) {
+			panic("unexpected fetch fallback")
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(rec.Value).To(Equal(value))
+		runtime.KeepAlive(rec)
+	}
+
+	runtime.KeepAlive(rec1)
+	runtime.KeepAlive(rec2)
+}
+
+func TestPreload(t *testing.T) {
+	g := NewWithT(t)
+
+	cache := weakcache.New(weakcache.WithGCInterval(10 * time.Millisecond))
+	defer cache.Close()
+
+	cache.Preload(map[string]interface{}{
+		"a": "value a",
+		"b": "value b",
+	}, 100*time.Millisecond, 0)
+
+	reachable, unreachable := cache.Counts()
+	g.Expect(reachable).To(Equal(0))
+	g.Expect(unreachable).To(Equal(2))
+
+	rec, err := cache.Fetch("a", 0, 0, func() (interface{}, error) {
+		panic("unexpected fetch fallback")
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(rec.Value).To(Equal("value a"))
+	g.Expect(cache.Stats().Hits).To(Equal(uint64(1)))
+
+	// The unreferenced preloaded record expires after minTTL.
+	g.Eventually(func() bool {
+		return cache.Contains("b")
+	}).Should(BeFalse())
+
+	runtime.KeepAlive(rec)
+}
@@ -0,0 +1,198 @@
+package weakcache
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are cumulative cache statistics.
+type Stats struct {
+	// Hits is the number of fetches served from the cache.
+	Hits uint64
+	// Misses is the number of fetches not served from the cache.
+	Misses uint64
+	// Evictions is the number of evicted records.
+	Evictions uint64
+	// DroppedEvents is the number of eviction events
+	// dropped because the event channel was full.
+	DroppedEvents uint64
+	// LastGCDuration is how long the last GC loop sweep held the cache lock.
+	LastGCDuration time.Duration
+	// MaxGCDuration is the longest time a GC loop sweep held the cache lock.
+	MaxGCDuration time.Duration
+	// Swept is the number of records inspected by the GC loop.
+	Swept uint64
+	// Sweeps is the number of GC loop ticks.
+	Sweeps uint64
+	// SweepTarget is the number of records the last adaptive
+	// sweep was allowed to inspect. See WithAdaptiveSweep.
+	SweepTarget int
+	// TotalWeight is the total weight of the cached records.
+	TotalWeight int64
+	// OrphanedUnrefs is the number of record pointers which were
+	// garbage collected after Close. They indicate leaked references.
+	OrphanedUnrefs uint64
+	// Fetches is the number of completed fetch fallbacks.
+	Fetches uint64
+	// FetchDuration is the total duration of the fetch fallbacks.
+	FetchDuration time.Duration
+	// MaxFetchDuration is the longest duration of a fetch fallback.
+	MaxFetchDuration time.Duration
+	// CoalescedWaits is the number of fetches which waited
+	// for a fallback started by another fetch of the same key.
+	CoalescedWaits uint64
+	// CoalescedWaitDuration is the total time spent in the coalesced waits.
+	CoalescedWaitDuration time.Duration
+	// SuspectedLeaks is the number of records which were referenced for
+	// longer than the threshold set by WithLeakDetection.
+	SuspectedLeaks uint64
+}
+
+type stats struct {
+	hits          atomic.Uint64
+	misses        atomic.Uint64
+	evictions     atomic.Uint64
+	droppedEvents atomic.Uint64
+	lastGC        atomic.Int64
+	maxGC         atomic.Int64
+	swept         atomic.Uint64
+	sweeps        atomic.Uint64
+	sweepTarget   atomic.Int64
+	weight        atomic.Int64
+	orphaned      atomic.Uint64
+	fetches       atomic.Uint64
+	fetchTime     atomic.Int64
+	maxFetchTime  atomic.Int64
+	waits         atomic.Uint64
+	waitTime      atomic.Int64
+	leaks         atomic.Uint64
+
+	// keys is nil unless per-key stats are enabled.
+	keysMu sync.Mutex
+	keys   map[string]*KeyStat
+}
+
+// KeyStat are the fetch statistics of a key.
+type KeyStat struct {
+	Key    string
+	Hits   uint64
+	Misses uint64
+}
+
+// addHit counts a cache hit of key.
+func (s *stats) addHit(key string) {
+	s.hits.Add(1)
+	if s.keys != nil {
+		s.addKey(key, true)
+	}
+}
+
+// addMiss counts a cache miss of key.
+func (s *stats) addMiss(key string) {
+	s.misses.Add(1)
+	if s.keys != nil {
+		s.addKey(key, false)
+	}
+}
+
+// addKey counts a hit or a miss in the stats of key.
+func (s *stats) addKey(key string, hit bool) {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+
+	ks, ok := s.keys[key]
+	if !ok {
+		// The key may share memory with a mutable buffer.
+		ks = &KeyStat{Key: strings.Clone(key)}
+		s.keys[ks.Key] = ks
+	}
+	if hit {
+		ks.Hits++
+	} else {
+		ks.Misses++
+	}
+}
+
+// addSweep records a sweep of n records which held the lock for d.
+// It is only called by the GC loop.
+func (s *stats) addSweep(n int, d time.Duration) {
+	s.sweeps.Add(1)
+	s.swept.Add(uint64(n))
+	s.lastGC.Store(int64(d))
+	if int64(d) > s.maxGC.Load() {
+		s.maxGC.Store(int64(d))
+	}
+}
+
+// addFetch records a fetch fallback which took d.
+func (s *stats) addFetch(d time.Duration) {
+	s.fetches.Add(1)
+	s.fetchTime.Add(int64(d))
+	for {
+		max := s.maxFetchTime.Load()
+		if int64(d) <= max || s.maxFetchTime.CompareAndSwap(max, int64(d)) {
+			return
+		}
+	}
+}
+
+// addWait records a fetch which waited for d on the fallback of another fetch.
+func (s *stats) addWait(d time.Duration) {
+	s.waits.Add(1)
+	s.waitTime.Add(int64(d))
+}
+
+// Stats returns the cache statistics.
+func (c *Cache) Stats() Stats {
+	return Stats{
+		Hits:                  c.stats.hits.Load(),
+		Misses:                c.stats.misses.Load(),
+		Evictions:             c.stats.evictions.Load(),
+		DroppedEvents:         c.stats.droppedEvents.Load(),
+		LastGCDuration:        time.Duration(c.stats.lastGC.Load()),
+		MaxGCDuration:         time.Duration(c.stats.maxGC.Load()),
+		Swept:                 c.stats.swept.Load(),
+		Sweeps:                c.stats.sweeps.Load(),
+		SweepTarget:           int(c.stats.sweepTarget.Load()),
+		TotalWeight:           c.stats.weight.Load(),
+		OrphanedUnrefs:        c.stats.orphaned.Load(),
+		Fetches:               c.stats.fetches.Load(),
+		FetchDuration:         time.Duration(c.stats.fetchTime.Load()),
+		MaxFetchDuration:      time.Duration(c.stats.maxFetchTime.Load()),
+		CoalescedWaits:        c.stats.waits.Load(),
+		CoalescedWaitDuration: time.Duration(c.stats.waitTime.Load()),
+		SuspectedLeaks:        c.stats.leaks.Load(),
+	}
+}
+
+// TopKeys returns the stats of the n most fetched keys, most fetched first.
+// It returns nil unless per-key stats are enabled with WithKeyStats.
+func (c *Cache) TopKeys(n int) []KeyStat {
+	if c.stats.keys == nil || n <= 0 {
+		return nil
+	}
+
+	c.stats.keysMu.Lock()
+	top := make([]KeyStat, 0, len(c.stats.keys))
+	for _, ks := range c.stats.keys {
+		top = append(top, *ks)
+	}
+	c.stats.keysMu.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		ti, tj := top[i].Hits+top[i].Misses, top[j].Hits+top[j].Misses
+		if ti != tj {
+			return ti > tj
+		}
+		return top[i].Key < top[j].Key
+	})
+
+	if n < len(top) {
+		top = top[:n]
+	}
+
+	return top
+}
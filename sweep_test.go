@@ -0,0 +1,140 @@
+package weakcache
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestSweepLimit(t *testing.T) {
+	g := NewWithT(t)
+
+	c := &Cache{
+		reachable:   make(recordMap),
+		unreachable: make(recordMap),
+		sweepLimit:  2,
+	}
+
+	for i := uint64(0); i < 5; i++ {
+		c.unreachable[i] = &Record{lastUnref: 1}
+		c.sweepQueue = append(c.sweepQueue, sweepItem{
+			index:     i,
+			lastUnref: 1,
+		})
+	}
+
+	// Each sweep resumes from where the previous one left off.
+	for _, expected := range []int{3, 1, 0} {
+		c.sweep(time.Now().UnixNano())
+		g.Expect(c.unreachable).To(HaveLen(expected))
+	}
+}
+
+func TestAdaptiveSweep(t *testing.T) {
+	g := NewWithT(t)
+
+	c := &Cache{
+		reachable:     make(recordMap),
+		unreachable:   make(recordMap),
+		adaptiveSweep: true,
+	}
+
+	index := uint64(0)
+	burst := func(n int, minTTL time.Duration) {
+		for i := 0; i < n; i++ {
+			c.addUnreachable(index, &Record{minTTL: int64(minTTL)}, time.Now().UnixNano())
+			index++
+		}
+	}
+
+	sweep := func() int {
+		return c.sweep(time.Now().Add(time.Second).UnixNano())
+	}
+
+	// Each sweep reaps a burst of expired records.
+	for _, n := range []int{10, 100, 1000} {
+		burst(n, 0)
+		g.Expect(sweep()).To(Equal(n))
+		g.Expect(c.stats.sweepTarget.Load()).To(Equal(int64(n)))
+		g.Expect(c.unreachable).To(BeEmpty())
+	}
+
+	// Records which have not expired are left in the backlog,
+	// a part of which is inspected on each sweep.
+	burst(320, time.Hour)
+	g.Expect(sweep()).To(Equal(320))
+	g.Expect(sweep()).To(Equal(320 / adaptiveSweepDivisor))
+
+	burst(100, 0)
+	g.Expect(sweep()).To(Equal(100 + 320/adaptiveSweepDivisor))
+}
+
+func BenchmarkSweep(b *testing.B) {
+	const size = 500000
+
+	for _, limit := range []int{0, defaultSweepLimit} {
+		b.Run(fmt.Sprintf("limit=%d", limit), func(b *testing.B) {
+			c := &Cache{
+				reachable:   make(recordMap),
+				unreachable: make(recordMap),
+				sweepLimit:  limit,
+			}
+
+			now := time.Now().UnixNano()
+			for i := uint64(0); i < size; i++ {
+				c.unreachable[i] = &Record{
+					minTTL:    int64(time.Hour),
+					lastUnref: now,
+				}
+				c.sweepQueue = append(c.sweepQueue, sweepItem{
+					index:     i,
+					lastUnref: now,
+				})
+			}
+
+			var maxHold time.Duration
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				c.mu.Lock()
+				c.sweep(now)
+				c.mu.Unlock()
+				if d := time.Since(start); d > maxHold {
+					maxHold = d
+				}
+			}
+
+			b.ReportMetric(float64(maxHold.Nanoseconds()), "max-hold-ns")
+		})
+	}
+}
+
+func TestSweepQueueBounded(t *testing.T) {
+	g := NewWithT(t)
+
+	c := New(WithGCInterval(0))
+	defer c.Close()
+
+	// Fetch and drop the record without sweeps.
+	for i := 0; i < 200; i++ {
+		_, err := c.Fetch("key", time.Minute, 0, func() (interface{}, error) {
+			return "value", nil
+		})
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Eventually(func() int {
+			runtime.GC()
+			_, unreachable := c.Counts()
+			return unreachable
+		}).Should(Equal(1))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	g.Expect(len(c.sweepQueue)).To(BeNumerically("<=", 2+sweepQueueSlack))
+}
@@ -0,0 +1,107 @@
+package weakcache
+
+import (
+	"context"
+	"runtime"
+)
+
+// unrefItem is a pending unref of the record generation gen at index.
+type unrefItem struct {
+	index uint64
+	gen   uint64
+}
+
+// queueUnref queues an unref to be applied by the unref worker.
+// It is called by finalizers so it must not block on the cache lock.
+func (c *Cache) queueUnref(index, gen uint64) {
+	c.unrefMu.Lock()
+	defer c.unrefMu.Unlock()
+
+	c.unrefQueue = append(c.unrefQueue, unrefItem{
+		index: index,
+		gen:   gen,
+	})
+
+	if !c.unrefBusy {
+		c.unrefBusy = true
+		go c.unrefWorker()
+	}
+}
+
+// unrefWorker applies queued unrefs until the queue is empty.
+func (c *Cache) unrefWorker() {
+	for {
+		c.unrefMu.Lock()
+		items := c.unrefQueue
+		c.unrefQueue = nil
+		if len(items) == 0 {
+			c.unrefBusy = false
+			for _, ch := range c.unrefIdle {
+				close(ch)
+			}
+			c.unrefIdle = nil
+			c.unrefMu.Unlock()
+			return
+		}
+		c.unrefMu.Unlock()
+
+		for _, item := range items {
+			c.unref(item.index, item.gen)
+		}
+	}
+}
+
+// waitUnrefs waits until all queued unrefs have been applied.
+func (c *Cache) waitUnrefs(ctx context.Context) error {
+	c.unrefMu.Lock()
+	if !c.unrefBusy {
+		c.unrefMu.Unlock()
+		return nil
+	}
+	idle := make(chan struct{})
+	c.unrefIdle = append(c.unrefIdle, idle)
+	c.unrefMu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Sync runs a garbage collection and blocks until the finalizers of
+// unreachable records have run, all queued unrefs have been applied
+// and the pending eviction callbacks have run. Afterwards, records
+// without live pointers are in the unreachable map.
+//
+// Sync is intended for tests and for draining unrefs before shutdown.
+func (c *Cache) Sync() {
+	runtime.GC()
+	flushFinalizers()
+	_ = c.waitUnrefs(context.Background())
+	_ = c.waitEvictions(context.Background())
+}
+
+// finalizerSentinel is a pointer-containing type
+// so that it is not allocated by the tiny allocator.
+type finalizerSentinel struct {
+	done chan struct{}
+}
+
+// flushFinalizers waits until all finalizers queued so far have run.
+// Finalizers run in batches on a single goroutine. The first sentinel
+// runs in the latest queued batch and the second one in a later batch,
+// which starts only after the previous batches have completed.
+func flushFinalizers() {
+	for i := 0; i < 2; i++ {
+		s := &finalizerSentinel{done: make(chan struct{})}
+		done := s.done
+		runtime.SetFinalizer(s, func(s *finalizerSentinel) {
+			close(s.done)
+		})
+		s = nil
+		runtime.GC()
+		<-done
+	}
+}
@@ -0,0 +1,81 @@
+package weakcache
+
+import "fmt"
+
+// Verify checks the internal consistency of the cache and returns an error
+// describing the first violation found. It is meant for tests.
+//
+// It checks that no index is in both the reachable and the unreachable map,
+// that records are stored at the index of their key, that referenced records
+// are reachable and unreferenced records are unreachable and queued for
+// sweeping, that no record which had expired when it was inspected by the
+// last full sweep remains, and that the total size and weight match the
+// records. Expired records kept by WithEvictionFilter or
+// WithServeStaleOnError are allowed.
+func (c *Cache) Verify() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	queued := make(map[sweepItem]bool, len(c.sweepQueue))
+	for _, item := range c.sweepQueue {
+		queued[item] = true
+	}
+
+	var bytes, unreachableBytes, weight int64
+
+	for index, rec := range c.reachable {
+		if _, ok := c.unreachable[index]; ok {
+			return fmt.Errorf("weakcache: key %q is both reachable and unreachable", rec.key)
+		}
+		if rec.refs == 0 {
+			return fmt.Errorf("weakcache: reachable key %q has no references", rec.key)
+		}
+		if err := c.verifyIndex(index, rec); err != nil {
+			return err
+		}
+		bytes += rec.size
+		weight += rec.weight
+	}
+
+	for index, rec := range c.unreachable {
+		if rec.refs != 0 {
+			return fmt.Errorf("weakcache: unreachable key %q has %d references", rec.key, rec.refs)
+		}
+		if rec.lastUnref <= 0 {
+			return fmt.Errorf("weakcache: unreachable key %q has no unreference time", rec.key)
+		}
+		if !queued[sweepItem{index: index, lastUnref: rec.lastUnref}] {
+			return fmt.Errorf("weakcache: unreachable key %q is not queued for sweeping", rec.key)
+		}
+		if c.lastSweep > 0 && c.evictFilter == nil && rec.lastUnref <= c.lastSweep &&
+			rec.isExpired(c.lastSweep) && !c.isStale(rec, c.lastSweep) {
+			return fmt.Errorf("weakcache: expired key %q remains after a sweep", rec.key)
+		}
+		if err := c.verifyIndex(index, rec); err != nil {
+			return err
+		}
+		bytes += rec.size
+		unreachableBytes += rec.size
+		weight += rec.weight
+	}
+
+	if bytes != c.bytes {
+		return fmt.Errorf("weakcache: total size is %d, records have %d", c.bytes, bytes)
+	}
+	if unreachableBytes != c.unreachableBytes {
+		return fmt.Errorf("weakcache: unreachable size is %d, records have %d", c.unreachableBytes, unreachableBytes)
+	}
+	if w := c.stats.weight.Load(); weight != w {
+		return fmt.Errorf("weakcache: total weight is %d, records have %d", w, weight)
+	}
+
+	return nil
+}
+
+// verifyIndex checks that rec is stored at the index of its key.
+func (c *Cache) verifyIndex(index uint64, rec *Record) error {
+	if c.index(rec.key) != index {
+		return fmt.Errorf("weakcache: key %q is stored at a wrong index", rec.key)
+	}
+	return nil
+}